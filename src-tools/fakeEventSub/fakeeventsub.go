@@ -0,0 +1,108 @@
+// standalone tool to send signed EventSub webhooks (as Twitch would) to a running bot
+// run in folder with .env file (uses EVENTSUB_SECRET, and EVENTSUB_CALLBACK or EVENTSUB_PORT)
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Pyorot/streams/src/eventsub"
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+var target string // URL to post to
+
+func init() {
+	// argument validation
+	if len(os.Args) != 4 && !(len(os.Args) == 2 && os.Args[1] == "v") {
+		exit()
+	}
+	// env vars
+	Env.Load()
+	eventsub.SetSecret(Env.GetOrExit("EVENTSUB_SECRET"))
+	if target = Env.GetOrEmpty("EVENTSUB_CALLBACK"); target == "" {
+		target = "http://localhost:" + Env.GetOrExit("EVENTSUB_PORT") + "/"
+	}
+}
+
+func main() {
+	mode, msgType, subType := os.Args[1], "notification", "stream.online"
+	var userID, userName string
+	if len(os.Args) == 4 {
+		userID, userName = os.Args[2], os.Args[3]
+	}
+	switch mode {
+	case "v":
+		msgType = "webhook_callback_verification"
+	case "on", "bad":
+	case "off":
+		subType = "stream.offline"
+	case "r":
+		msgType = "revocation"
+	default:
+		exit()
+	}
+
+	// build body
+	body := map[string]interface{}{
+		"subscription": map[string]interface{}{
+			"id":        "fake-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+			"type":      subType,
+			"version":   "1",
+			"status":    IfThenElse(mode == "r", "authorization_revoked", "enabled"),
+			"condition": map[string]string{"broadcaster_user_id": userID},
+		},
+	}
+	if mode == "v" {
+		body["challenge"] = "fake-challenge"
+	} else if msgType == "notification" {
+		body["event"] = map[string]string{
+			"broadcaster_user_id":    userID,
+			"broadcaster_user_login": userName,
+			"broadcaster_user_name":  userName,
+			"type":                   "live",
+		}
+	}
+	data, err := json.Marshal(body)
+	ExitIfError(err)
+
+	// sign and post
+	msgID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+	signature := eventsub.Sign(msgID, timestamp, data)
+	if mode == "bad" {
+		signature = eventsub.Sign(msgID, timestamp, append(data, ' ')) // should be rejected
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(data))
+	ExitIfError(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Twitch-Eventsub-Message-Id", msgID)
+	req.Header.Set("Twitch-Eventsub-Message-Timestamp", timestamp)
+	req.Header.Set("Twitch-Eventsub-Message-Signature", signature)
+	req.Header.Set("Twitch-Eventsub-Message-Type", msgType)
+	req.Header.Set("Twitch-Eventsub-Subscription-Type", subType)
+	res, err := http.DefaultClient.Do(req)
+	ExitIfError(err)
+	defer res.Body.Close()
+	reply, _ := ioutil.ReadAll(res.Body)
+	fmt.Printf(". | %s %s → HTTP %d %s\n", msgType, subType, res.StatusCode, reply)
+}
+
+func exit() {
+	fmt.Print(
+		"Usage: Posts a signed EventSub message to a running bot.\n",
+		"./fakeeventsub on 12826 twitch  -- stream.online for user ID 12826 (display name twitch)\n",
+		"./fakeeventsub off 12826 twitch -- stream.offline\n",
+		"./fakeeventsub r 12826 twitch   -- revocation of stream.online\n",
+		"./fakeeventsub bad 12826 twitch -- stream.online with a wrong signature (should get 403)\n",
+		"./fakeeventsub v                -- callback verification challenge\n",
+	)
+	os.Exit(0)
+}
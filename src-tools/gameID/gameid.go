@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/Pyorot/streams/src/auth"
 	. "github.com/Pyorot/streams/src/utils"
 	"github.com/nicklaw5/helix"
 )
@@ -36,9 +37,7 @@ func init() {
 		ClientSecret: Env.GetOrExit("TWITCH_SEC"),
 	})
 	ExitIfError(err)
-	res, err := twitch.GetAppAccessToken(nil)
-	ExitIfError(err)
-	twitch.SetAppAccessToken(res.Data.AccessToken)
+	auth.Init(twitch)
 }
 
 func main() {
@@ -6,6 +6,7 @@ package main
 import (
 	"fmt"
 
+	"github.com/Pyorot/streams/src/auth"
 	. "github.com/Pyorot/streams/src/utils"
 
 	"github.com/nicklaw5/helix"
@@ -24,9 +25,7 @@ func init() {
 		ClientSecret: Env.GetOrExit("TWITCH_SEC"),
 	})
 	ExitIfError(err)
-	res, err := twitch.GetAppAccessToken(nil)
-	ExitIfError(err)
-	twitch.SetAppAccessToken(res.Data.AccessToken)
+	auth.Init(twitch)
 	getStreamsParams = helix.StreamsParams{
 		GameIDs: []string{Env.GetOrExit("GAME_ID")}, // list of games to query
 		First:   100,                                // maximum query results (limit is 100)
@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Pyorot/streams/src/auth"
 	. "github.com/Pyorot/streams/src/utils"
 	"github.com/nicklaw5/helix"
 
@@ -45,9 +46,7 @@ func init() {
 		ClientSecret: Env.GetOrExit("TWITCH_SEC"),
 	})
 	ExitIfError(err)
-	res, err := twitch.GetAppAccessToken(nil)
-	ExitIfError(err)
-	twitch.SetAppAccessToken(res.Data.AccessToken)
+	auth.Init(twitch)
 	getStreamsParams = helix.StreamsParams{
 		GameIDs: []string{os.Args[2]},
 		First:   100,
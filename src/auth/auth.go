@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/Pyorot/streams/src/utils"
+
+	"github.com/nicklaw5/helix"
+)
+
+// auth manages the Twitch app access token of a helix client, for the main program and the tools:
+// it gets + validates a token on init, renews it shortly before it expires (or once Twitch rejects it),
+// and only ever logs it redacted
+
+const renewMargin = time.Hour // renew this long before expiry
+
+var twitch *helix.Client // Twitch client whose token is managed
+var token string         // current token
+var expiry time.Time     // when the current token expires (by expires_in)
+var valid bool           // is current token believed to be valid? (false until init, or after Invalidate)
+var lock sync.Mutex      // mutex for all of the above (callers are in many threads)
+
+// Init : sync init: gets a token for the client and validates it (fatal if credentials are rejected)
+func Init(twitch_ *helix.Client) {
+	twitch = twitch_
+	lock.Lock()
+	defer lock.Unlock()
+	renew(true)
+	ok, res, err := twitch.ValidateToken(token)
+	if err == nil && !ok {
+		err = fmt.Errorf("HTTP %d: %s", res.StatusCode, res.ErrorMessage)
+	}
+	ExitIfError(err)
+	Log.Insta <- fmt.Sprintf("< | a: validated %s (client %s)", Redact(token), res.Data.ClientID)
+}
+
+// Token : returns a valid token, renewing it first if required (blocking, retry until success)
+func Token() string {
+	lock.Lock()
+	defer lock.Unlock()
+	if !valid || time.Until(expiry) < renewMargin {
+		renew(false)
+	}
+	return token
+}
+
+// Invalidate : flags the current token as rejected (e.g. after a 401), so the next Token() renews it
+func Invalidate() {
+	lock.Lock()
+	valid = false
+	lock.Unlock()
+}
+
+// Redact : shortens a token so it can be logged
+func Redact(token string) string {
+	if len(token) <= 4 {
+		return "****"
+	}
+	return token[:4] + "…"
+}
+
+// blocking http request to get a new token (retry until success; fatal on rejected credentials if init)
+func renew(init bool) {
+	for {
+		res, err := twitch.GetAppAccessToken(nil) // make api call
+		if err == nil && res.StatusCode != 200 {  // reinterpret HTTP error as actual error
+			err = fmt.Errorf("HTTP %d: %s", res.StatusCode, res.ErrorMessage)
+			if init && res.StatusCode < 500 {
+				panic(fmt.Sprintf("Twitch rejected credentials: %s", err))
+			}
+		}
+		if err == nil {
+			token, valid = res.Data.AccessToken, true
+			expiry = time.Now().Add(time.Duration(res.Data.ExpiresIn) * time.Second)
+			if res.Data.ExpiresIn == 0 { // not reported: rely on Invalidate (avoids renewing on every call)
+				expiry = time.Now().AddDate(1, 0, 0)
+			}
+			twitch.SetAppAccessToken(token)
+			Log.Insta <- fmt.Sprintf("< | a: %s (expires %s)", Redact(token), expiry.Format("2006-01-02 15:04"))
+			return
+		}
+		Log.Insta <- fmt.Sprintf("x | <a : %s", err)
+		time.Sleep(20 * time.Second)
+	}
+}
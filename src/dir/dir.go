@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/Pyorot/streams/src/discordapi"
 	. "github.com/Pyorot/streams/src/utils"
 
 	"github.com/bwmarrin/discordgo"
@@ -16,28 +17,32 @@ import (
 // the channel contains a bunch of posts in the format (where dui = Discord userID, tun = Twitch username):
 // "dir<comment>\n<dui1>\s<tun1>\n<dui2>\s<tun2>\n..."
 
-var discord *discordgo.Session // Discord session (managed at higher level)
-var channel string             // dir channel
-var data map[string]string     // map: twitch user -> Discord user ID
-var blocks map[string]bool     // set: twitch user
-var lock sync.Mutex            // mutex for data (blocks is only accessed in one thread)
+var discord discordapi.API // Discord client (managed at higher level)
+var channel string         // dir channel
+var data map[string]string // map: twitch user -> Discord user ID
+var blocks map[string]bool // set: twitch user
+var lock sync.Mutex        // mutex for data (blocks is only accessed in one thread)
 
 // Init : async init of dir component
-func Init(discord_ *discordgo.Session) chan (bool) {
+func Init(discord_ discordapi.API) chan (bool) {
 	res := make(chan (bool), 1)
 	go func() {
 		discord = discord_
 		channel, managed = Env.GetOrExit("DIR_CHANNEL"), Env.GetOrEmpty("DIR_MANAGED") == "true"
 		if managed {
-			gameName, serverID = Env.GetOrExit("GAME_NAME"), Env.GetOrExit("SERVER")
+			gameNames, serverID = strings.Split(Env.GetOrExit("GAME_NAME"), "|"), Env.GetOrExit("SERVER")
+			session := discordapi.Session(discord) // managed mode listens on the gateway, which only a real session has
+			if session == nil {
+				panic("DIR_MANAGED requires a real Discord session (unset DISCORD_FAKE)")
+			}
 			go manage()                                                                      // start worker reading from addCh
-			discord.AddHandler(add)                                                          // start callback posting to addCh
-			discord.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsGuildPresences) // 2020 api change: opt into events
-			err := discord.Open()                                                            // start connection, trigger Ready event
+			session.AddHandler(add)                                                          // start callback posting to addCh
+			session.Identify.Intents = discordgo.MakeIntent(discordgo.IntentsGuildPresences) // 2020 api change: opt into events
+			err := session.Open()                                                            // start connection, trigger Ready event
 			ExitIfError(err)
 		}
 		Load() // await Ready event, then load
-		Log.Insta <- fmt.Sprintf("d | init [%d|%d] (%s-%-5t) (%s, %s)", len(data), len(blocks), channel, managed, serverID, gameName)
+		Log.Insta <- fmt.Sprintf("d | init [%d|%d] (%s-%-5t) (%s, %s)", len(data), len(blocks), channel, managed, serverID, strings.Join(gameNames, "|"))
 		res <- true
 	}()
 	return res
@@ -47,7 +52,7 @@ func Init(discord_ *discordgo.Session) chan (bool) {
 func Load() {
 	// 0: await init (required for step 2.2)
 	if managed {
-		for discord.State.User == nil {
+		for discordapi.SelfID(discord) == "" {
 		}
 	}
 	// 1: load posts from channel
@@ -57,6 +62,7 @@ func Load() {
 	dataInv := make(map[string]string, 70) // ephemeral, just to check for duplicates
 	blocksNew := make(map[string]bool, 10)
 	var latestAutoMsgID int64
+	selfID := discordapi.SelfID(discord) // "" if unmanaged (session never opened)
 	// 2: process each dir message
 	for _, msg := range history {
 		if len(msg.Content) >= 4 && msg.Content[:3] == "dir" {
@@ -84,7 +90,7 @@ func Load() {
 			// 2.2: assign last message
 			msgID, err := strconv.ParseInt(msg.ID, 10, 64)
 			ExitIfError(err)
-			if discord.State.User != nil && msg.Author.ID == discord.State.User.ID && msgID > latestAutoMsgID {
+			if selfID != "" && msg.Author.ID == selfID && msgID > latestAutoMsgID {
 				latestAutoMsgID, manMsgID = msgID, msg.ID
 			}
 		} else if len(msg.Content) >= 6 && msg.Content[:5] == "block" {
@@ -0,0 +1,35 @@
+package dir
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Pyorot/streams/src/discordapi"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestLoad(t *testing.T) {
+	fake := discordapi.NewFake()
+	post := func(text string) { fake.Post("dir", "300000000000000000", &discordgo.MessageSend{Content: text}) }
+	post("dir speedrunners\n111 Alice\n222 bob")
+	post("not a dir post\n333 carol")
+	post("dir (more)\n  444 Dave  \n555 eve")
+	post("block trolls\nTroll\n spammer ")
+	os.Setenv("DIR_CHANNEL", "dir")
+	<-Init(fake)
+
+	for k, want := range map[string]string{"alice": "111", "bob": "222", "dave": "444", "eve": "555", "carol": "", "Alice": ""} {
+		if got := Get(k); got != want {
+			t.Errorf("Get(%q) = %q, want %q", k, got, want)
+		}
+	}
+	for k, want := range map[string]bool{"troll": true, "spammer": true, "alice": false} {
+		if got := IsBlocked(k); got != want {
+			t.Errorf("IsBlocked(%q) = %t, want %t", k, got, want)
+		}
+	}
+	if inverse := Inverse(); len(inverse) != 4 || inverse["444"] != "dave" {
+		t.Errorf("Inverse() = %v", inverse)
+	}
+}
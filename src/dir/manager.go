@@ -11,7 +11,7 @@ import (
 )
 
 var managed bool                               // manage dir (vs treating it as read-only)
-var gameName string                            // (if managed) param for onUpdate
+var gameNames []string                         // (if managed) param for onUpdate (GAME_NAME, |-separated)
 var serverID string                            // (if managed) param for onUpdate
 var manMsgID string                            // current managed message
 var addCh = make(chan (struct{ k, v string })) // channel connecting manage() and add()
@@ -25,7 +25,7 @@ func manage() {
 		if p.k == "" { // p.k is blanked iff success
 			p = <-addCh
 		} else {
-			time.Sleep(15 * time.Second)
+			Clock.Sleep(15 * time.Second)
 		}
 		manMsgIDCopy := manMsgID // copy for concurrency coherency
 		var msg *discordgo.Message
@@ -74,7 +74,7 @@ func add(s *discordgo.Session, pu *discordgo.PresenceUpdate) {
 		filter := pu.GuildID == serverID &&
 			a.Name == "Twitch" &&
 			a.Type == discordgo.GameTypeStreaming &&
-			a.State == gameName
+			isTracked(a.State)
 		if filter {
 			k, v := a.URL[strings.LastIndex(a.URL, "/")+1:], pu.User.ID
 			lock.Lock()
@@ -87,3 +87,13 @@ func add(s *discordgo.Session, pu *discordgo.PresenceUpdate) {
 		}
 	}
 }
+
+// is a game name one of the managed ones?
+func isTracked(game string) bool {
+	for _, name := range gameNames {
+		if strings.EqualFold(game, name) {
+			return true
+		}
+	}
+	return false
+}
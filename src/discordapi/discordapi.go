@@ -0,0 +1,43 @@
+package discordapi
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordapi is the narrow slice of the Discord REST API the bot uses (msg channels, role, dir),
+// so a session can be swapped for an in-memory Fake (offline runs, exercising msg/role/dir logic without a network)
+
+// API : the Discord calls the bot makes; *discordgo.Session implements it
+type API interface {
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error)
+	ChannelMessage(channelID, messageID string) (*discordgo.Message, error)
+	ChannelMessageSend(channelID string, content string) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error)
+	ChannelMessageEdit(channelID, messageID, content string) (*discordgo.Message, error)
+	ChannelMessageEditComplex(m *discordgo.MessageEdit) (*discordgo.Message, error)
+	GuildMembers(guildID string, after string, limit int) ([]*discordgo.Member, error)
+	GuildMemberRoleAdd(guildID, userID, roleID string) error
+	GuildMemberRoleRemove(guildID, userID, roleID string) error
+}
+
+var _ API = (*discordgo.Session)(nil)
+var _ API = (*Fake)(nil)
+
+// Session : the real session behind an API (for the gateway, e.g. dir's managed mode), or nil if it's a fake
+func Session(api API) *discordgo.Session {
+	session, _ := api.(*discordgo.Session)
+	return session
+}
+
+// SelfID : the user ID of the bot behind an API ("" if not known yet, i.e. before the gateway's Ready event)
+func SelfID(api API) string {
+	switch api := api.(type) {
+	case *discordgo.Session:
+		if api.State != nil && api.State.User != nil {
+			return api.State.User.ID
+		}
+	case *Fake:
+		return FakeSelfID
+	}
+	return ""
+}
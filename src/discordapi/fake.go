@@ -0,0 +1,248 @@
+package discordapi
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// FakeSelfID : the user ID of the bot in a Fake (author of msgs it posts)
+const FakeSelfID = "100000000000000000"
+
+// Fake : in-memory Discord (channels of msgs + guilds of members with roles), safe for concurrent use
+// msg IDs increase with posting order and have a fixed width, so compare like real snowflakes
+// (as strings); unknown msgs give the same "HTTP 404" errors as a session
+type Fake struct {
+	Log      func(string)                            // called with a line per write (nil for silence)
+	channels map[string][]*discordgo.Message         // channel ID → msgs, oldest first
+	guilds   map[string]map[string]*discordgo.Member // guild ID → user ID → member
+	nextID   int64                                   // next msg ID
+	lock     sync.Mutex                              // mutex for all of the above
+}
+
+// NewFake : constructor for an empty Fake
+func NewFake() *Fake {
+	return &Fake{
+		channels: make(map[string][]*discordgo.Message),
+		guilds:   make(map[string]map[string]*discordgo.Member),
+		nextID:   200000000000000000,
+	}
+}
+
+// AddMember : seeds a guild member with roles (replacing any existing one)
+func (f *Fake) AddMember(guildID, userID string, roles ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.guilds[guildID] == nil {
+		f.guilds[guildID] = make(map[string]*discordgo.Member)
+	}
+	f.guilds[guildID][userID] = &discordgo.Member{GuildID: guildID, User: &discordgo.User{ID: userID}, Roles: append([]string{}, roles...)}
+}
+
+// Post : seeds a msg in a channel as if posted by authorID; returns its ID
+func (f *Fake) Post(channelID, authorID string, msg *discordgo.MessageSend) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.post(channelID, authorID, msg).ID
+}
+
+// Messages : copies of the msgs in a channel, oldest first (for inspection)
+func (f *Fake) Messages(channelID string) []discordgo.Message {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	msgs := make([]discordgo.Message, len(f.channels[channelID]))
+	for i, msg := range f.channels[channelID] {
+		msgs[i] = *msg
+	}
+	return msgs
+}
+
+// Roles : the roles of a guild member (nil if not a member)
+func (f *Fake) Roles(guildID, userID string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if member := f.guilds[guildID][userID]; member != nil {
+		return append([]string{}, member.Roles...)
+	}
+	return nil
+}
+
+// ChannelMessages : the latest msgs in a channel, newest first (paging params other than limit are unsupported)
+func (f *Fake) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string) ([]*discordgo.Message, error) {
+	if beforeID != "" || afterID != "" || aroundID != "" {
+		return nil, fmt.Errorf("fake: ChannelMessages paging is unsupported")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	msgs := f.channels[channelID]
+	out := make([]*discordgo.Message, 0, limit)
+	for i := len(msgs) - 1; i >= 0 && len(out) < limit; i-- {
+		msg := *msgs[i]
+		out = append(out, &msg)
+	}
+	return out, nil
+}
+
+// ChannelMessage : a msg by ID
+func (f *Fake) ChannelMessage(channelID, messageID string) (*discordgo.Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	msg, err := f.find(channelID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	out := *msg
+	return &out, nil
+}
+
+// ChannelMessageSend : posts a text msg as the bot
+func (f *Fake) ChannelMessageSend(channelID string, content string) (*discordgo.Message, error) {
+	return f.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: content})
+}
+
+// ChannelMessageSendComplex : posts a msg as the bot
+func (f *Fake) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	msg := f.post(channelID, FakeSelfID, data)
+	f.log(fmt.Sprintf("f | %s + %s: %q", channelID, msg.ID, msg.Content))
+	out := *msg
+	return &out, nil
+}
+
+// ChannelMessageEdit : replaces the text of a msg
+func (f *Fake) ChannelMessageEdit(channelID, messageID, content string) (*discordgo.Message, error) {
+	return f.ChannelMessageEditComplex(&discordgo.MessageEdit{Channel: channelID, ID: messageID, Content: &content})
+}
+
+// ChannelMessageEditComplex : replaces the text and/or embed of a msg
+func (f *Fake) ChannelMessageEditComplex(m *discordgo.MessageEdit) (*discordgo.Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	msg, err := f.find(m.Channel, m.ID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Content != nil {
+		msg.Content = *m.Content
+	}
+	if m.Embed != nil {
+		msg.Embeds = []*discordgo.MessageEmbed{normalise(m.Embed)}
+		f.log(fmt.Sprintf("f | %s ~ %s: %s (#%06x)", m.Channel, m.ID, m.Embed.Author.Name, m.Embed.Color))
+	} else {
+		f.log(fmt.Sprintf("f | %s ~ %s: %q", m.Channel, m.ID, msg.Content))
+	}
+	msg.EditedTimestamp = discordgo.Timestamp(time.Now().Format(time.RFC3339))
+	out := *msg
+	return &out, nil
+}
+
+// GuildMembers : up to limit members with user IDs above after, in order of ID
+func (f *Fake) GuildMembers(guildID string, after string, limit int) ([]*discordgo.Member, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	userIDs := make([]string, 0, len(f.guilds[guildID]))
+	for userID := range f.guilds[guildID] {
+		if after == "" || snowflakeLess(after, userID) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return snowflakeLess(userIDs[i], userIDs[j]) })
+	if len(userIDs) > limit {
+		userIDs = userIDs[:limit]
+	}
+	out := make([]*discordgo.Member, len(userIDs))
+	for i, userID := range userIDs {
+		member := *f.guilds[guildID][userID]
+		member.Roles = append([]string{}, member.Roles...)
+		out[i] = &member
+	}
+	return out, nil
+}
+
+// GuildMemberRoleAdd : gives a member a role
+func (f *Fake) GuildMemberRoleAdd(guildID, userID, roleID string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	member := f.guilds[guildID][userID]
+	if member == nil {
+		return fmt.Errorf("HTTP 404 Not Found, {\"message\": \"Unknown Member\", \"code\": 10007}")
+	}
+	for _, role := range member.Roles {
+		if role == roleID {
+			return nil
+		}
+	}
+	member.Roles = append(member.Roles, roleID)
+	f.log(fmt.Sprintf("f | %s + role %s", userID, roleID))
+	return nil
+}
+
+// GuildMemberRoleRemove : takes a role from a member
+func (f *Fake) GuildMemberRoleRemove(guildID, userID, roleID string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	member := f.guilds[guildID][userID]
+	if member == nil {
+		return fmt.Errorf("HTTP 404 Not Found, {\"message\": \"Unknown Member\", \"code\": 10007}")
+	}
+	for i, role := range member.Roles {
+		if role == roleID {
+			member.Roles = append(member.Roles[:i:i], member.Roles[i+1:]...)
+			f.log(fmt.Sprintf("f | %s - role %s", userID, roleID))
+			break
+		}
+	}
+	return nil
+}
+
+// (under lock) appends a new msg to a channel
+func (f *Fake) post(channelID, authorID string, data *discordgo.MessageSend) *discordgo.Message {
+	msg := &discordgo.Message{
+		ID:        strconv.FormatInt(f.nextID, 10),
+		ChannelID: channelID,
+		Content:   data.Content,
+		Timestamp: discordgo.Timestamp(time.Now().Format(time.RFC3339)),
+		Author:    &discordgo.User{ID: authorID},
+	}
+	if data.Embed != nil {
+		msg.Embeds = []*discordgo.MessageEmbed{normalise(data.Embed)}
+	}
+	f.nextID++
+	f.channels[channelID] = append(f.channels[channelID], msg)
+	return msg
+}
+
+// (under lock) finds a msg by ID
+func (f *Fake) find(channelID, messageID string) (*discordgo.Message, error) {
+	for _, msg := range f.channels[channelID] {
+		if msg.ID == messageID {
+			return msg, nil
+		}
+	}
+	return nil, fmt.Errorf("HTTP 404 Not Found, {\"message\": \"Unknown Message\", \"code\": 10008}")
+}
+
+// copies an embed as Discord would store it (timestamps come back as "+00:00" rather than "Z")
+func normalise(embed *discordgo.MessageEmbed) *discordgo.MessageEmbed {
+	out := *embed
+	if t, err := time.Parse(time.RFC3339, embed.Timestamp); err == nil {
+		out.Timestamp = t.UTC().Format("2006-01-02T15:04:05+00:00")
+	}
+	return &out
+}
+
+func (f *Fake) log(line string) {
+	if f.Log != nil {
+		f.Log(line)
+	}
+}
+
+// compares snowflake IDs numerically (they're decimal strings of varying length)
+func snowflakeLess(a, b string) bool {
+	return len(a) < len(b) || len(a) == len(b) && a < b
+}
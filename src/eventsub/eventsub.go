@@ -0,0 +1,152 @@
+package eventsub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+// eventsub receives Twitch EventSub webhooks for stream.online/stream.offline and forwards them on Events
+// every request is signed by Twitch: sha256 HMAC of (message ID + timestamp + body) with our secret
+// subscriptions (one per broadcaster per type) are managed by subscribe.go
+
+// Event : a broadcaster going online or offline
+type Event struct {
+	Type      string // "stream.online" or "stream.offline"
+	UserID    string // broadcaster_user_id
+	UserLogin string // broadcaster_user_login
+	UserName  string // broadcaster_user_name (display name)
+}
+
+// Events : channel whence main loop reads incoming events
+var Events = make(chan Event, 100)
+
+var secret string                     // shared secret for signatures, ≥10 chars (EVENTSUB_SECRET)
+var callback string                   // public URL Twitch posts to (EVENTSUB_CALLBACK)
+var seen = make(map[string]time.Time) // message IDs already handled (Twitch may redeliver), pruned after 10m
+var seenLock sync.Mutex               // mutex for seen (handler runs in many threads)
+
+// payload of a notification/verification/revocation request (fields we use)
+type message struct {
+	Challenge    string       `json:"challenge"`
+	Subscription subscription `json:"subscription"`
+	Event        struct {
+		UserID    string `json:"broadcaster_user_id"`
+		UserLogin string `json:"broadcaster_user_login"`
+		UserName  string `json:"broadcaster_user_name"`
+	} `json:"event"`
+}
+
+// Init : starts the webhook server (async) and the subscription worker; blocks until existing subscriptions are loaded
+func Init(secret_, callback_, port, clientID_ string) {
+	secret, callback, clientID = secret_, callback_, clientID_
+	if len(secret) < 10 || len(secret) > 100 {
+		panic("EVENTSUB_SECRET must be 10-100 chars long")
+	}
+	u, err := url.Parse(callback)
+	ExitIfError(err)
+	path := IfThenElse(u.Path == "", "/", u.Path)
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, handle)
+	go func() {
+		err := http.ListenAndServe(":"+port, mux)
+		ExitIfError(err) // only returns on failure
+	}()
+	if clientID != "" { // no client ID = receive-only (e.g. testing with a fake sender)
+		loadSubscriptions()
+		go manage()
+		go prune()
+	}
+	Log.Insta <- fmt.Sprintf("e | init [%d] (:%s%s)", len(subscribed), port, path)
+}
+
+// http handler for all requests from Twitch
+func handle(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil || r.Method != http.MethodPost {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	// 1: authenticate
+	msgID := r.Header.Get("Twitch-Eventsub-Message-Id")
+	timestamp := r.Header.Get("Twitch-Eventsub-Message-Timestamp")
+	if !Verify(msgID, timestamp, r.Header.Get("Twitch-Eventsub-Message-Signature"), body) {
+		Log.Insta <- fmt.Sprintf("x | e : bad signature (%s)", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+	sentAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil || time.Since(sentAt) > 10*time.Minute { // replay protection
+		http.Error(w, "stale message", http.StatusForbidden)
+		return
+	}
+	if isDuplicate(msgID) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var m message
+	if err := json.Unmarshal(body, &m); err != nil {
+		http.Error(w, "bad body", http.StatusBadRequest)
+		return
+	}
+	// 2: act on message
+	switch r.Header.Get("Twitch-Eventsub-Message-Type") {
+	case "webhook_callback_verification":
+		Log.Insta <- fmt.Sprintf("e | ok %s %s", m.Subscription.Type, m.Subscription.Condition.UserID)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(m.Challenge))
+	case "notification":
+		Log.Insta <- fmt.Sprintf("e | %s %s", IfThenElse(m.Subscription.Type == "stream.online", "↑", "↓"), m.Event.UserLogin)
+		w.WriteHeader(http.StatusNoContent) // respond before blocking on Events
+		Events <- Event{m.Subscription.Type, m.Event.UserID, m.Event.UserLogin, m.Event.UserName}
+	case "revocation":
+		Log.Insta <- fmt.Sprintf("! | e: revoked %s %s (%s)", m.Subscription.Type, m.Subscription.Condition.UserID, m.Subscription.Status)
+		unregister(m.Subscription.Type, m.Subscription.Condition.UserID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Verify : checks a request signature ("sha256=<hex>") against our secret
+func Verify(msgID, timestamp, signature string, body []byte) bool {
+	expected := Sign(msgID, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// Sign : computes the signature Twitch would send for a request (also used by fake senders)
+func Sign(msgID, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msgID + timestamp))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SetSecret : sets the signing secret without starting a server (for fake senders)
+func SetSecret(secret_ string) {
+	secret = secret_
+}
+
+// registers a message ID, returning true if it was already registered
+func isDuplicate(msgID string) bool {
+	seenLock.Lock()
+	defer seenLock.Unlock()
+	now := time.Now()
+	for id, t := range seen {
+		if now.Sub(t) > 10*time.Minute {
+			delete(seen, id)
+		}
+	}
+	_, exists := seen[msgID]
+	seen[msgID] = now
+	return exists
+}
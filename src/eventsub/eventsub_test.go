@@ -0,0 +1,75 @@
+package eventsub
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBody = `{"challenge":"pogchamp-kappa-360noscope-vohiyo","subscription":{"type":"stream.online","version":"1",` +
+	`"condition":{"broadcaster_user_id":"1337"}},"event":{"broadcaster_user_id":"1337","broadcaster_user_login":"cool_user",` +
+	`"broadcaster_user_name":"Cool_User"}}`
+
+func TestHandle(t *testing.T) {
+	SetSecret("s3cRe7s3cRe7")
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	stale := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	tests := []struct {
+		name      string
+		msgID     string // (distinct per test, else they'd be duplicates)
+		timestamp string
+		signature string // "" to sign correctly
+		msgType   string
+		status    int
+		reply     string // expected body (if any)
+		event     bool   // expected to forward an event
+	}{
+		{"challenge", "1", now, "", "webhook_callback_verification", 200, "pogchamp-kappa-360noscope-vohiyo", false},
+		{"notification", "2", now, "", "notification", 204, "", true},
+		{"duplicate", "2", now, "", "notification", 204, "", false},
+		{"bad signature", "3", now, "sha256=00", "notification", 403, "bad signature", false},
+		{"signed with another secret", "4", now, "sha256=" + strings.Repeat("ab", 32), "notification", 403, "bad signature", false},
+		{"stale", "5", stale, "", "notification", 403, "stale message", false},
+	}
+	for _, test := range tests {
+		signature := test.signature
+		if signature == "" {
+			signature = Sign(test.msgID, test.timestamp, []byte(testBody))
+		}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(testBody))
+		req.Header.Set("Twitch-Eventsub-Message-Id", test.msgID)
+		req.Header.Set("Twitch-Eventsub-Message-Timestamp", test.timestamp)
+		req.Header.Set("Twitch-Eventsub-Message-Signature", signature)
+		req.Header.Set("Twitch-Eventsub-Message-Type", test.msgType)
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.status)
+		}
+		if reply := strings.TrimSpace(rec.Body.String()); test.reply != "" && reply != test.reply {
+			t.Errorf("%s: reply %q, want %q", test.name, reply, test.reply)
+		}
+		select {
+		case e := <-Events:
+			if !test.event {
+				t.Errorf("%s: forwarded %v", test.name, e)
+			} else if e != (Event{"stream.online", "1337", "cool_user", "Cool_User"}) {
+				t.Errorf("%s: forwarded %v", test.name, e)
+			}
+		default:
+			if test.event {
+				t.Errorf("%s: forwarded nothing", test.name)
+			}
+		}
+	}
+}
+
+func TestHandleRejectsGet(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handle(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,234 @@
+package eventsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Pyorot/streams/src/auth"
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+const subscriptionsURL = "https://api.twitch.tv/helix/eventsub/subscriptions"
+
+var types = []string{"stream.online", "stream.offline"} // subscription types managed per broadcaster
+
+var clientID string                       // Twitch client ID (as for helix)
+var subscribed = make(map[string]bool)    // set: type + ":" + broadcaster user ID (enabled or pending)
+var queued = make(map[string]bool)        // set: broadcaster user IDs in subCh or being subscribed
+var rejected = make(map[string]time.Time) // broadcaster user ID → when Twitch last refused a subscription (not retried for a while)
+var lastSeen = make(map[string]time.Time) // broadcaster user ID → when last passed to Subscribe (or loaded), for pruning
+var lock sync.Mutex                       // mutex for all of the above
+var subCh = make(chan string, 1000)       // channel connecting Subscribe() and manage(): broadcaster user IDs
+
+const rejectedWait = time.Hour        // how long before a refused subscription is tried again
+const pruneAfter = 7 * 24 * time.Hour // how long a broadcaster can go unseen before eir subscriptions are deleted
+const pruneInterval = 24 * time.Hour  // how often to look for subscriptions to prune
+
+// a subscription as represented by Twitch (fields we use)
+type subscription struct {
+	ID        string `json:"id,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Type      string `json:"type"`
+	Version   string `json:"version"`
+	Condition struct {
+		UserID string `json:"broadcaster_user_id"`
+	} `json:"condition"`
+	Transport struct {
+		Method   string `json:"method"`
+		Callback string `json:"callback"`
+		Secret   string `json:"secret,omitempty"`
+	} `json:"transport"`
+}
+
+// Subscribe : non-blocking request to ensure a broadcaster's online/offline events are subscribed to
+func Subscribe(userID string) {
+	if clientID == "" {
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	lastSeen[userID] = time.Now()
+	if isSubscribed(userID) || queued[userID] || time.Since(rejected[userID]) < rejectedWait {
+		return
+	}
+	select {
+	case subCh <- userID:
+		queued[userID] = true
+	default: // queue full; poll will retry on a later snapshot
+	}
+}
+
+// (under lock)
+func isSubscribed(userID string) bool {
+	for _, t := range types {
+		if !subscribed[t+":"+userID] {
+			return false
+		}
+	}
+	return true
+}
+
+func register(t, userID string) {
+	lock.Lock()
+	subscribed[t+":"+userID] = true
+	lock.Unlock()
+}
+
+func unregister(t, userID string) {
+	lock.Lock()
+	delete(subscribed, t+":"+userID)
+	lock.Unlock()
+}
+
+// worker to read user IDs from subCh and create their subscriptions (retrying network/server errors until success;
+// anything else Twitch refuses is dropped, and not queued again for rejectedWait)
+func manage() {
+	for userID := range subCh {
+	userTypes:
+		for _, t := range types {
+			for {
+				lock.Lock()
+				done := subscribed[t+":"+userID]
+				lock.Unlock()
+				if done {
+					break
+				}
+				var s subscription
+				s.Type, s.Version, s.Condition.UserID = t, "1", userID
+				s.Transport.Method, s.Transport.Callback, s.Transport.Secret = "webhook", callback, secret
+				status, err := request("POST", subscriptionsURL, s, nil)
+				if err == nil || status == http.StatusConflict { // 409: already exists
+					register(t, userID)
+					Log.Insta <- fmt.Sprintf("e | + %s %s", t, userID)
+					break
+				}
+				Log.Insta <- fmt.Sprintf("x | e+: %s", err)
+				if !retriable(status) {
+					lock.Lock()
+					rejected[userID] = time.Now()
+					lock.Unlock()
+					break userTypes
+				}
+				time.Sleep(15 * time.Second)
+			}
+		}
+		lock.Lock()
+		delete(queued, userID)
+		lock.Unlock()
+	}
+}
+
+// is a failed request worth retrying? (network errors, server errors and expired tokens; not 429s, which Twitch gives
+// once the subscriptions' max_total_cost is used up, so would stall the queue until some are pruned)
+func retriable(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusUnauthorized
+}
+
+// worker to delete the subscriptions of broadcasters not seen for pruneAfter (e.g. who stopped streaming the game)
+func prune() {
+	for {
+		time.Sleep(pruneInterval)
+		count := 0
+		err := eachSubscription(func(s subscription) {
+			lock.Lock()
+			stale := time.Since(lastSeen[s.Condition.UserID]) > pruneAfter
+			lock.Unlock()
+			if !stale {
+				return
+			}
+			if _, err := request("DELETE", subscriptionsURL+"?id="+s.ID, nil, nil); err != nil {
+				Log.Insta <- fmt.Sprintf("x | e-: %s", err)
+				return
+			}
+			unregister(s.Type, s.Condition.UserID)
+			count++
+		})
+		if err != nil {
+			Log.Insta <- fmt.Sprintf("x | e-: %s", err)
+		}
+		Log.Insta <- fmt.Sprintf("e | pruned [%d]", count)
+	}
+}
+
+// blocking http req to load our existing subscriptions into state, deleting failed ones (so they can be recreated)
+func loadSubscriptions() {
+	err := eachSubscription(func(s subscription) {
+		if s.Status == "enabled" || s.Status == "webhook_callback_verification_pending" {
+			register(s.Type, s.Condition.UserID)
+			lock.Lock()
+			lastSeen[s.Condition.UserID] = time.Now() // (so prune gives them time to be seen)
+			lock.Unlock()
+		} else if _, err := request("DELETE", subscriptionsURL+"?id="+s.ID, nil, nil); err != nil {
+			Log.Insta <- fmt.Sprintf("x | e-: %s", err)
+		}
+	})
+	ExitIfError(err)
+}
+
+// blocking http reqs to call f on each of our subscriptions (page by page)
+func eachSubscription(f func(subscription)) error {
+	cursor := ""
+	for {
+		var page struct {
+			Data       []subscription `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+		}
+		_, err := request("GET", subscriptionsURL+IfThenElse(cursor == "", "", "?after="+cursor), nil, &page)
+		if err != nil {
+			return err
+		}
+		for _, s := range page.Data {
+			if s.Transport.Callback == callback { // (else someone else's, e.g. another instance)
+				f(s)
+			}
+		}
+		if cursor = page.Pagination.Cursor; cursor == "" {
+			return nil
+		}
+	}
+}
+
+// blocking http req to the subscriptions endpoint; returns status code, and error if not 2xx
+func request(method, url string, in interface{}, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Client-ID", clientID)
+	req.Header.Set("Authorization", "Bearer "+auth.Token())
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		auth.Invalidate()
+	}
+	if res.StatusCode/100 != 2 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		return res.StatusCode, fmt.Errorf("HTTP %d: %s", res.StatusCode, e.Message)
+	}
+	if out != nil {
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	}
+	return res.StatusCode, nil
+}
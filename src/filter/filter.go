@@ -0,0 +1,340 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// filter is a small boolean expression language over the properties of a stream, e.g.
+// (tag:speedrun or title~/any%/) and lang:en and not user:foo
+//
+// terms:  tag:<tag>      has a tag (ignoring case)
+//         title:<text>   title contains text (ignoring case); title~/<regexp>/ matches regexp (ignoring case)
+//         user:<name>    login or display name is name (ignoring case); user~/<regexp>/
+//         lang:<code>    broadcast language, e.g. en
+//         game:<game>    game ID or name (ignoring case)
+//         type:<type>    stream type, e.g. live
+//         viewers<op><n> viewer count, op one of = != < <= > >= (viewers:<n> means =)
+//         dir            user is in dir
+//         mature         stream is flagged mature
+// combine with: not, and, or (binding in that order), and (brackets)
+// values with spaces or brackets go in "quotes"
+
+// Stream : the properties of a stream that expressions can test
+type Stream struct {
+	Login, User, Title, Language, GameID, GameName, Type string
+	Tags                                                 []string
+	Viewers                                              int
+	Known, Mature                                        bool
+}
+
+// Expr : a parsed expression
+type Expr struct {
+	src  string
+	root node
+}
+
+// Error : a parse error at a position (1-based, in runes) in the source
+type Error struct {
+	Src string
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("filter: %s at position %d\n  %s\n  %s^", e.Msg, e.Pos, e.Src, strings.Repeat(" ", e.Pos-1))
+}
+
+// Parse : compiles an expression, or returns an *Error pointing at what's wrong
+func Parse(src string) (*Expr, error) {
+	p := &parser{src: src}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, p.errorAt(t, "unexpected "+t.describe())
+	}
+	return &Expr{src, root}, nil
+}
+
+// Eval : tests a stream against the expression
+func (e *Expr) Eval(s *Stream) bool {
+	return e.root.eval(s)
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// ---- evaluation ----
+
+type node interface {
+	eval(s *Stream) bool
+}
+
+type andNode struct{ l, r node }
+type orNode struct{ l, r node }
+type notNode struct{ x node }
+type flagNode struct{ field string }
+type matchNode struct {
+	field string         // tag, title, user, lang, game, type
+	value string         // for ":" (lowercased)
+	re    *regexp.Regexp // for "~"
+}
+type viewersNode struct {
+	op string
+	n  int
+}
+
+func (n andNode) eval(s *Stream) bool { return n.l.eval(s) && n.r.eval(s) }
+func (n orNode) eval(s *Stream) bool  { return n.l.eval(s) || n.r.eval(s) }
+func (n notNode) eval(s *Stream) bool { return !n.x.eval(s) }
+
+func (n flagNode) eval(s *Stream) bool {
+	if n.field == "dir" {
+		return s.Known
+	}
+	return s.Mature
+}
+
+func (n matchNode) eval(s *Stream) bool {
+	var candidates []string
+	switch n.field {
+	case "tag":
+		candidates = s.Tags
+	case "title":
+		if n.re == nil {
+			return strings.Contains(strings.ToLower(s.Title), n.value)
+		}
+		candidates = []string{s.Title}
+	case "user":
+		candidates = []string{s.Login, s.User}
+	case "lang":
+		candidates = []string{s.Language}
+	case "game":
+		candidates = []string{s.GameID, s.GameName}
+	case "type":
+		candidates = []string{s.Type}
+	}
+	for _, c := range candidates {
+		if n.re != nil && n.re.MatchString(c) || n.re == nil && strings.ToLower(c) == n.value {
+			return true
+		}
+	}
+	return false
+}
+
+func (n viewersNode) eval(s *Stream) bool {
+	switch n.op {
+	case "=", ":":
+		return s.Viewers == n.n
+	case "!=":
+		return s.Viewers != n.n
+	case "<":
+		return s.Viewers < n.n
+	case "<=":
+		return s.Viewers <= n.n
+	case ">":
+		return s.Viewers > n.n
+	default: // ">="
+		return s.Viewers >= n.n
+	}
+}
+
+// ---- lexing ----
+
+const (
+	tEOF    = iota
+	tWord   // bare word (keyword, field, or unquoted value)
+	tString // "quoted value"
+	tRegexp // /regexp/
+	tOp     // : ~ = != < <= > >=
+	tLParen // (
+	tRParen // )
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int // 1-based rune position
+}
+
+func (t token) describe() string {
+	switch t.kind {
+	case tEOF:
+		return "end of expression"
+	case tLParen, tRParen, tOp:
+		return `"` + t.text + `"`
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+type parser struct {
+	src    string
+	tokens []token
+	i      int
+}
+
+func (p *parser) lex() error {
+	runes := []rune(p.src)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		pos := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			p.tokens = append(p.tokens, token{tLParen, "(", pos})
+			i++
+		case c == ')':
+			p.tokens = append(p.tokens, token{tRParen, ")", pos})
+			i++
+		case c == '"' || c == '/':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(runes) && runes[j] != c; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) && runes[j+1] == c { // escaped delimiter
+					j++
+				}
+				b.WriteRune(runes[j])
+			}
+			kind, name := tString, "string"
+			if c == '/' {
+				kind, name = tRegexp, "regexp"
+			}
+			if j == len(runes) {
+				return &Error{p.src, pos, "unterminated " + name}
+			}
+			p.tokens = append(p.tokens, token{kind, b.String(), pos})
+			i = j + 1
+		case strings.ContainsRune(":~=!<>", c):
+			j := i + 1
+			if j < len(runes) && runes[j] == '=' && strings.ContainsRune("!<>", c) {
+				j++
+			} else if c == '!' {
+				return &Error{p.src, pos, `expected "!="`}
+			}
+			p.tokens = append(p.tokens, token{tOp, string(runes[i:j]), pos})
+			i = j
+		default:
+			j := i
+			for j < len(runes) && !strings.ContainsRune(" \t\n()\":~=!<>", runes[j]) {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tWord, string(runes[i:j]), pos})
+			i = j
+		}
+	}
+	p.tokens = append(p.tokens, token{tEOF, "", len(runes) + 1})
+	return nil
+}
+
+// ---- parsing (recursive descent) ----
+
+func (p *parser) peek() token { return p.tokens[p.i] }
+func (p *parser) next() token { // (stays on the final tEOF, so a term cut short errors rather than reading past it)
+	t := p.tokens[p.i]
+	if t.kind != tEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(t token, keyword string) bool {
+	return t.kind == tWord && strings.ToLower(t.text) == keyword
+}
+
+func (p *parser) errorAt(t token, msg string) *Error {
+	return &Error{p.src, t.pos, msg}
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.isKeyword(p.peek(), "or") {
+		p.next()
+		var r node
+		if r, err = p.parseAnd(); err == nil {
+			l = orNode{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseNot()
+	for err == nil && p.isKeyword(p.peek(), "and") {
+		p.next()
+		var r node
+		if r, err = p.parseNot(); err == nil {
+			l = andNode{l, r}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.isKeyword(p.peek(), "not") {
+		p.next()
+		x, err := p.parseNot()
+		return notNode{x}, err
+	}
+	return p.parseTerm()
+}
+
+func (p *parser) parseTerm() (node, error) {
+	t := p.next()
+	switch {
+	case t.kind == tLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tRParen {
+			return nil, p.errorAt(closing, `expected ")" to close "(" at position `+strconv.Itoa(t.pos)+", got "+closing.describe())
+		}
+		return x, nil
+	case t.kind != tWord || p.isKeyword(t, "and") || p.isKeyword(t, "or"):
+		return nil, p.errorAt(t, "expected a term, got "+t.describe())
+	}
+	field := strings.ToLower(t.text)
+	switch field {
+	case "dir", "mature":
+		return flagNode{field}, nil
+	case "viewers":
+		op, value := p.next(), p.next()
+		if op.kind != tOp || op.text == "~" {
+			return nil, p.errorAt(op, "expected a comparison after viewers, got "+op.describe())
+		}
+		n, err := strconv.Atoi(value.text)
+		if value.kind != tWord || err != nil {
+			return nil, p.errorAt(value, "expected a number, got "+value.describe())
+		}
+		return viewersNode{op.text, n}, nil
+	case "tag", "title", "user", "lang", "game", "type":
+		op, value := p.next(), p.next()
+		switch {
+		case op.kind == tOp && op.text == ":" && (value.kind == tWord || value.kind == tString):
+			return matchNode{field: field, value: strings.ToLower(value.text)}, nil
+		case op.kind == tOp && op.text == "~" && value.kind == tRegexp:
+			if _, err := regexp.Compile(value.text); err != nil { // (compiled plain first so the error quotes it as written)
+				return nil, p.errorAt(value, strings.TrimPrefix(err.Error(), "error parsing "))
+			}
+			return matchNode{field: field, re: regexp.MustCompile("(?i)" + value.text)}, nil
+		case op.kind == tOp && op.text == "~":
+			return nil, p.errorAt(value, "expected /regexp/ after ~, got "+value.describe())
+		case op.kind == tOp && op.text == ":":
+			return nil, p.errorAt(value, "expected a value after :, got "+value.describe())
+		default:
+			return nil, p.errorAt(op, `expected ":" or "~" after `+field+", got "+op.describe())
+		}
+	default:
+		return nil, p.errorAt(t, fmt.Sprintf("unknown term %q", t.text))
+	}
+}
@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+var sample = &Stream{
+	Login: "runner", User: "Runner", Title: "Any% PB attempts", Language: "en",
+	GameID: "2692", GameName: "Super Mario 64", Type: "live",
+	Tags: []string{"Speedrun", "English"}, Viewers: 42, Known: true,
+}
+
+func TestEval(t *testing.T) {
+	cases := []struct {
+		src  string
+		want bool
+	}{
+		{"tag:speedrun", true},
+		{"tag:casual", false},
+		{`title:"pb att"`, true},
+		{"title~/^any%/", true},
+		{"title~/^pb/", false},
+		{"user:RUNNER and lang:en", true},
+		{"user~/^run/", true},
+		{`game:"super mario 64" and game:2692`, true},
+		{"type:live and not mature", true},
+		{"viewers>=42 and viewers<43 and viewers:42 and viewers!=41", true},
+		{"viewers>42 or viewers<=41", false},
+		{"dir", true},
+		{"not dir or tag:casual", false},
+		{"tag:casual or tag:speedrun and lang:en", true}, // and binds tighter than or
+		{"(tag:casual or tag:speedrun) and lang:ja", false},
+		{"not not dir", true},
+	}
+	for _, c := range cases {
+		expr, err := Parse(c.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", c.src, err)
+			continue
+		}
+		if got := expr.Eval(sample); got != c.want {
+			t.Errorf("Parse(%q).Eval() = %t, want %t", c.src, got, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		src string
+		pos int
+		msg string // substring of the message
+	}{
+		{"viewers", 8, "expected a comparison after viewers, got end of expression"},
+		{"tag", 4, `expected ":" or "~" after tag, got end of expression`},
+		{"lang:en and viewers", 20, "expected a comparison after viewers"},
+		{"viewers>", 9, "expected a number, got end of expression"},
+		{"viewers>x", 9, `expected a number, got "x"`},
+		{"viewers~/1/", 8, "expected a comparison"},
+		{"title:", 7, "expected a value after :, got end of expression"},
+		{"title~", 7, "expected /regexp/ after ~, got end of expression"},
+		{"title~/(/", 7, "missing closing )"},
+		{"tag:a and", 10, "expected a term, got end of expression"},
+		{"not", 4, "expected a term"},
+		{"(tag:a", 7, `expected ")" to close "(" at position 1`},
+		{"tag:a)", 6, `unexpected ")"`},
+		{"tag:a tag:b", 7, `unexpected "tag"`},
+		{"foo", 1, `unknown term "foo"`},
+		{`title:"open`, 7, "unterminated string"},
+		{"viewers!5", 8, `expected "!="`},
+		{"", 1, "expected a term, got end of expression"},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.src)
+		ferr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Parse(%q) = %v, want *Error", c.src, err)
+			continue
+		}
+		if ferr.Pos != c.pos || !strings.Contains(ferr.Msg, c.msg) {
+			t.Errorf("Parse(%q): error %q at %d, want %q at %d", c.src, ferr.Msg, ferr.Pos, c.msg, c.pos)
+		}
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	_, err := Parse("lang:en and viewers")
+	want := "filter: expected a comparison after viewers, got end of expression at position 20\n  lang:en and viewers\n                     ^"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Pyorot/streams/src/auth"
+	. "github.com/Pyorot/streams/src/utils"
+
+	"github.com/nicklaw5/helix"
+)
+
+// looks up what's left of a stream once it's ended (for expired msgs), once per stream for all agents
+
+const vodTolerance = 5 * time.Minute // max gap between a stream's start and its VOD's creation
+const clipsShown = 3                 // max number of clips to show (the most viewed)
+const archiveTTL = 24 * time.Hour    // how long to keep a look-up for other agents (whose expiry windows may be longer)
+
+type archive struct {
+	vod     string        // as findVOD
+	clips   []helix.Clip  // as findClips
+	fetched time.Time     // when it was looked up
+	done    chan struct{} // closed once vod and clips are set
+}
+
+var archives = make(map[string]*archive) // cache of look-ups shared by agents (user ID + stream start → archive)
+var archivesLock sync.Mutex              // mutex for archives
+
+// blocking http requests to find the archive VOD and clips of an ended stream: the first agent to ask looks them up,
+// and the others wait for and reuse its result; returns "" and nil if none/offline
+func findArchive(s *stream) (vod string, clips []helix.Clip) {
+	if twitch == nil || s.userID == "" {
+		return "", nil // offline (replay), or msg posted before user IDs were persisted
+	}
+	key := s.userID + "@" + s.start.UTC().Format(time.RFC3339)
+	archivesLock.Lock()
+	a, exists := archives[key]
+	if !exists {
+		for k, old := range archives { // prune (in-flight look-ups are recent, so never pruned)
+			if Clock.Since(old.fetched) > archiveTTL {
+				delete(archives, k)
+			}
+		}
+		a = &archive{fetched: Clock.Now(), done: make(chan struct{})}
+		archives[key] = a
+	}
+	archivesLock.Unlock()
+	if exists {
+		<-a.done
+	} else {
+		a.vod, a.clips = findVOD(s), findClips(s)
+		close(a.done)
+	}
+	return a.vod, a.clips
+}
+
+// blocking http request to find the archive VOD of an ended stream (one attempt); returns its URL, or "" if none
+func findVOD(s *stream) string {
+	auth.Token()
+	res, err := twitch.GetVideos(&helix.VideosParams{UserID: s.userID, Type: "archive", First: 20})
+	if err == nil {
+		err = helixError(&res.ResponseCommon)
+	}
+	if err != nil {
+		Log.Insta <- fmt.Sprintf("x | <v : %s", err)
+		return ""
+	}
+	for _, v := range res.Data.Videos { // newest first; a resumed stream has several, so match the first broadcast's start
+		created, err := time.Parse(time.RFC3339, v.CreatedAt)
+		if err == nil && created.Sub(s.start) < vodTolerance && s.start.Sub(created) < vodTolerance {
+			return v.URL
+		}
+	}
+	return ""
+}
+
+// blocking http request to find the most viewed clips made during an ended stream (one attempt); returns nil if none
+func findClips(s *stream) []helix.Clip {
+	auth.Token()
+	res, err := twitch.GetClips(&helix.ClipsParams{
+		BroadcasterID: s.userID,
+		StartedAt:     helix.Time{Time: s.start.UTC()},
+		EndedAt:       helix.Time{Time: s.start.Add(s.length).UTC()},
+		First:         clipsShown, // sorted by views
+	})
+	if err == nil {
+		err = helixError(&res.ResponseCommon)
+	}
+	if err != nil {
+		Log.Insta <- fmt.Sprintf("x | <c : %s", err)
+		return nil
+	}
+	return res.Data.Clips
+}
@@ -1,58 +1,418 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Pyorot/streams/src/auth"
 	. "github.com/Pyorot/streams/src/utils"
 
 	"github.com/nicklaw5/helix"
 )
 
-var getStreamsParams helix.StreamsParams // the const argument for getStreams calls, initialised in main.go:init()
-var authed bool                          // is current auth token believed to be valid?
+var getStreamsParams helix.StreamsParams // the const argument for getStreams calls, initialised in main.go:init() (copied per fetch)
+var gameNames = make(map[string]string)  // names of tracked games (game ID → name), from resolveGames
+var avatars = make(map[string]avatar)    // cache of profile images (user ID → image), from resolveAvatars (main thread only)
+var twitchClientID string                // for requests not made via helix
 
-// blocking http request to Twitch getStreams
-func fetch() (map[string]*stream, error) {
-	dict := make(map[string]*stream) // the return dict (twitch username → stream object)
-	getStreamsParams.After = ""
-	for { // repeat until no more pages
-		auth()                                           // renew auth token if required
-		res, err := twitch.GetStreams(&getStreamsParams) // make api call
-		if err == nil && res.StatusCode != 200 {         // reinterpret HTTP error as actual error
-			err = fmt.Errorf("HTTP %d: %s", res.StatusCode, res.ErrorMessage)
+type avatar struct {
+	url     string    // profile image URL ("" if the user has none)
+	fetched time.Time // when it was looked up
+}
+
+const avatarTTL = 24 * time.Hour // how long to cache a profile image (users rarely change them)
+
+// a stream as returned by Helix getStreams: helix.Stream predates some fields, which are added here
+type twitchStream struct {
+	helix.Stream
+	UserLogin string   `json:"user_login"` // ascii handle (absent from recordings made before it was added)
+	Tags      []string `json:"tags"`       // freeform tags (replacing TagIDs)
+	IsMature  bool     `json:"is_mature"`  //
+	GameName  string   `json:"game_name"`  // (absent from recordings made before it was added)
+}
+
+// response to getStreams (as helix.StreamsResponse, but with twitchStream)
+type streamsResponse struct {
+	helix.ResponseCommon
+	Data struct {
+		Streams    []twitchStream   `json:"data"`
+		Pagination helix.Pagination `json:"pagination"`
+	}
+}
+
+const pollInterval = 60 * time.Second   // poll interval while the rate-limit budget is healthy
+const pollIntervalMax = 5 * time.Minute // cap on adaptive slow-down
+const budgetReserve = 10                // points left untouched when paging (for auth, events etc.)
+const pageAttempts = 4                  // tries per page before a fetch fails
+const pageBackoff = 2 * time.Second     // wait before the 2nd try of a page (doubling after)
+
+// live stream source: polls Twitch getStreams, optionally recording each snapshot for replay
+type helixSource struct {
+	record    *json.Encoder // if non-nil, appends every fetched snapshot (see source.go)
+	limit     int           // rate-limit bucket size (points per minute), from last response (0 if unknown)
+	remaining int           // rate-limit points remaining, from last response
+	reset     time.Time     // when the bucket is next full, from last response
+	pages     int           // requests (= points) used by the last fetch, inc. retries
+}
+
+// synchronous constructor for helixSource; recordPath may be "" (no recording)
+func newHelixSource(recordPath string) *helixSource {
+	h := &helixSource{}
+	if recordPath != "" {
+		file, err := os.OpenFile(recordPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		ExitIfError(err)
+		h.record = json.NewEncoder(file)
+		Log.Insta <- fmt.Sprintf(". | recording snapshots to %s", recordPath)
+	}
+	return h
+}
+
+// blocking http request to Twitch getStreams; all-or-nothing: returns every page, or nil and an error
+// (a partial snapshot would look like the streams on the missing pages had gone offline)
+func (h *helixSource) fetch() (map[string]*stream, error) {
+	list := make([]twitchStream, 0) // raw results from all pages
+	params := getStreamsParams      // copy, so the cursor is local to this fetch
+	h.pages = 0
+	for page := 1; ; page++ { // repeat until no more pages
+		res, err := h.fetchPage(&params, page)
+		if err != nil {
+			return nil, err
 		}
-		cursor := res.Data.Pagination.Cursor
+		list = append(list, res.Data.Streams...)
+		if res.Data.Pagination.Cursor == "" {
+			break // if the cursor is empty, we're at the end of the list, we can exit now
+		}
+		params.After = res.Data.Pagination.Cursor
+	}
+	if h.record != nil {
+		if err := h.record.Encode(snapshot{time.Now(), list}); err != nil {
+			Log.Insta <- fmt.Sprintf("x | <w : %s", err) // recording is best-effort; don't fail the fetch
+		}
+	}
+	return newStreamsFromTwitch(list), nil
+}
+
+// blocking http request for one page of getStreams, retried with exponential backoff
+func (h *helixSource) fetchPage(params *helix.StreamsParams, page int) (*streamsResponse, error) {
+	backoff := pageBackoff
+	for attempt := 1; ; attempt++ {
+		h.awaitBudget()                // slow down paging if nearly throttled
+		res, err := getStreams(params) // make api call (renews auth token if required)
+		if res != nil {
+			h.updateBudget(&res.ResponseCommon)
+		}
+		if err == nil { // reinterpret HTTP error as actual error (a 401 triggers re-auth next try)
+			err = helixError(&res.ResponseCommon)
+		}
+		h.pages++
 		if err == nil {
-			list := res.Data.Streams // result is in list format
-			for i := range list {    // recompile into target dict format with custom stream structs
-				dict[strings.ToLower(list[i].UserName)] = newStreamFromTwitch(&list[i])
+			return res, nil
+		}
+		Log.Insta <- fmt.Sprintf("x | < : %s (page %d, try %d/%d)", err, page, attempt, pageAttempts)
+		if attempt == pageAttempts {
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// blocking http request to Twitch getStreams for a single user (e.g. on a stream.online event)
+func (h *helixSource) fetchUser(userID string) (*stream, error) {
+	res, err := getStreams(&helix.StreamsParams{UserIDs: []string{userID}})
+	if res != nil {
+		h.updateBudget(&res.ResponseCommon)
+	}
+	if err == nil {
+		err = helixError(&res.ResponseCommon)
+	}
+	if err != nil {
+		Log.Insta <- fmt.Sprintf("x | <u : %s", err)
+		return nil, err
+	}
+	for i, r := range res.Data.Streams {
+		for _, gameID := range getStreamsParams.GameIDs {
+			if r.GameID == gameID {
+				return newStreamFromTwitch(&res.Data.Streams[i]), nil
 			}
-			if cursor == "" {
-				break // if the cursor is empty, we're at the end of the list, we can exit now
+		}
+	}
+	return nil, nil // not live, or live in a game we don't track
+}
+
+// blocking http request to Twitch getStreams by user (one attempt per ≤100 users); all-or-nothing, as fetch
+func (h *helixSource) fetchElsewhere(userIDs []string) (map[string]string, error) {
+	elsewhere := make(map[string]string) // user ID → game name
+	err := inBatches(userIDs, func(batch []string) error {
+		res, err := getStreams(&helix.StreamsParams{UserIDs: batch, First: 100})
+		if res != nil {
+			h.updateBudget(&res.ResponseCommon)
+		}
+		if err == nil {
+			err = helixError(&res.ResponseCommon)
+		}
+		if err != nil {
+			return err
+		}
+		for _, r := range res.Data.Streams {
+			if !contains(getStreamsParams.GameIDs, r.GameID) {
+				elsewhere[r.UserID] = IfThenElse(r.GameName != "", r.GameName, "another category")
 			}
-			getStreamsParams.After = cursor
-		} else {
-			authed = !(res != nil && res.StatusCode == 401) // trigger re-auth next run iff last error was 401 (deref ptr first!)
-			Log.Insta <- fmt.Sprintf("x | < : %s", err)
-			break
 		}
+		return nil
+	})
+	if err != nil {
+		Log.Insta <- fmt.Sprintf("x | <e : %s", err)
+		return nil, err
 	}
-	return dict, err
+	return elsewhere, nil
 }
 
-// blocking http request to renew Twitch auth token if required, retry until success
-func auth() {
-	for !authed {
-		res, err := twitch.GetAppAccessToken(nil) // make api call
+// blocking http request to Helix getStreams (direct, to decode fields helix.Stream lacks)
+func getStreams(params *helix.StreamsParams) (*streamsResponse, error) {
+	query := url.Values{"game_id": params.GameIDs, "user_id": params.UserIDs}
+	if params.First != 0 {
+		query.Set("first", strconv.Itoa(params.First))
+	}
+	if params.After != "" {
+		query.Set("after", params.After)
+	}
+	req, err := http.NewRequest("GET", helix.DefaultAPIBaseURL+"/streams?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Client-ID", twitchClientID)
+	req.Header.Set("Authorization", "Bearer "+auth.Token())
+	httpRes, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpRes.Body.Close()
+	res := &streamsResponse{}
+	res.StatusCode, res.Header = httpRes.StatusCode, httpRes.Header
+	if res.StatusCode == 200 {
+		err = json.NewDecoder(httpRes.Body).Decode(&res.Data)
+	} else {
+		json.NewDecoder(httpRes.Body).Decode(&res.ResponseCommon) // best-effort, for ErrorMessage
+	}
+	return res, err
+}
+
+// records the rate-limit budget from the headers of a Helix response
+func (h *helixSource) updateBudget(res *helix.ResponseCommon) {
+	if res.Header.Get("Ratelimit-Limit") == "" {
+		return // e.g. failed before reaching Twitch
+	}
+	h.limit, h.remaining = res.GetRateLimit(), res.GetRateLimitRemaining()
+	h.reset = time.Unix(int64(res.GetRateLimitReset()), 0)
+}
+
+// blocking wait until the bucket refills, if it's down to the reserve
+func (h *helixSource) awaitBudget() {
+	if h.limit == 0 || h.remaining > budgetReserve {
+		return
+	}
+	if wait := time.Until(h.reset); wait > 0 {
+		if wait > pollInterval {
+			wait = pollInterval
+		}
+		Log.Insta <- fmt.Sprintf("! | < : budget %d/%d, waiting %s", h.remaining, h.limit, wait.Round(time.Second))
+		time.Sleep(wait)
+	}
+	h.remaining = h.limit // assume refilled until the next response says otherwise
+}
+
+// chooses the time until the next poll from the last known budget: the base interval while at least
+// half the bucket is left, then slower in proportion, and never before a refill if a poll wouldn't fit
+func (h *helixSource) interval() time.Duration {
+	interval := pollInterval
+	if h.limit > 0 && h.remaining < h.limit/2 {
+		interval = time.Duration(float64(pollInterval) * float64(h.limit) / float64(2*h.remaining+1))
+		if untilReset := time.Until(h.reset); h.remaining < h.pages+budgetReserve && untilReset > interval {
+			interval = untilReset
+		}
+		if interval > pollIntervalMax {
+			interval = pollIntervalMax
+		}
+	}
+	Log.Bkgd <- fmt.Sprintf("< | budget %d/%d (%dp) → %s", h.remaining, h.limit, h.pages, interval.Round(time.Second))
+	return interval
+}
+
+// blocking http request to resolve tracked games from GAME_ID and/or GAME_NAME (lists separated by commas and by |s
+// respectively, as game names can contain commas, e.g. "Papers, Please");
+// fatal if any is unknown to Twitch, or if both are set and don't name the same games
+func resolveGames(rawIDs, rawNames string) []string {
+	var params helix.GamesParams
+	if rawIDs != "" {
+		params.IDs = strings.Split(rawIDs, ",")
+	}
+	if rawNames != "" {
+		params.Names = strings.Split(rawNames, "|")
+	}
+	if len(params.IDs) == 0 && len(params.Names) == 0 {
+		panic("Missing env var: GAME_ID or GAME_NAME")
+	}
+	auth.Token()
+	res, err := twitch.GetGames(&params)
+	if err == nil {
+		err = helixError(&res.ResponseCommon)
+	}
+	ExitIfError(err)
+	byID, byName := make(map[string]string), make(map[string]string) // ID → name, lowercase name → ID
+	for _, g := range res.Data.Games {
+		byID[g.ID], byName[strings.ToLower(g.Name)] = g.Name, g.ID
+	}
+	// check each list resolves
+	for _, id := range params.IDs {
+		if _, exists := byID[id]; !exists {
+			panic(fmt.Sprintf("GAME_ID %s is not a Twitch game", id))
+		}
+	}
+	namedIDs := make([]string, 0, len(params.Names))
+	for _, name := range params.Names {
+		id, exists := byName[strings.ToLower(name)]
+		if !exists {
+			panic(fmt.Sprintf("GAME_NAME \"%s\" is not a Twitch game (names must match Twitch exactly)", name))
+		}
+		namedIDs = append(namedIDs, id)
+	}
+	// cross-check the lists name the same games
+	ids := params.IDs
+	if len(ids) == 0 {
+		ids = namedIDs
+	} else if len(params.Names) != 0 {
+		for _, id := range ids {
+			if !contains(namedIDs, id) {
+				panic(fmt.Sprintf("GAME_ID %s is \"%s\", which is missing from GAME_NAME %q", id, byID[id], params.Names))
+			}
+		}
+		for i, id := range namedIDs {
+			if !contains(ids, id) {
+				panic(fmt.Sprintf("GAME_NAME \"%s\" is ID %s, which is missing from GAME_ID %q", params.Names[i], id, ids))
+			}
+		}
+	}
+	for _, id := range ids {
+		gameNames[id] = byID[id]
+		Log.Insta <- fmt.Sprintf(". | game %s \"%s\"", id, byID[id])
+	}
+	return ids
+}
+
+// blocking http request to look up the Twitch user IDs of logins (map keys); unknown logins are omitted
+func resolveLogins(logins map[string]string) map[string]string {
+	userIDs := make(map[string]string, len(logins)) // login → user ID
+	if twitch == nil {
+		return userIDs // offline (replay)
+	}
+	all := make([]string, 0, len(logins))
+	for login := range logins {
+		all = append(all, login)
+	}
+	ExitIfError(inBatches(all, func(batch []string) error {
+		auth.Token()
+		res, err := twitch.GetUsers(&helix.UsersParams{Logins: batch})
 		if err == nil {
-			twitch.SetAppAccessToken(res.Data.AccessToken)
-			authed = true
-			Log.Insta <- fmt.Sprintf("< | a: %s", res.Data.AccessToken)
-		} else {
-			Log.Insta <- fmt.Sprintf("x | <a : %s", err)
-			time.Sleep(20 * time.Second)
+			err = helixError(&res.ResponseCommon)
+		}
+		if err != nil {
+			return err
 		}
+		for _, u := range res.Data.Users {
+			userIDs[u.Login] = u.ID
+		}
+		return nil
+	}))
+	return userIDs
+}
+
+// blocking http request to set the profile images of streams (cached with a TTL, so only uncached users are looked up),
+// replacing those that change with copies; best-effort: on error, streams of uncached users go without (main thread only)
+func resolveAvatars(streams map[string]*stream) {
+	if twitch == nil {
+		return // offline (replay)
+	}
+	stale := make([]string, 0)
+	for user := range streams {
+		if a, exists := avatars[user]; !exists || time.Since(a.fetched) > avatarTTL {
+			stale = append(stale, user)
+		}
+	}
+	err := inBatches(stale, func(batch []string) error {
+		auth.Token()
+		res, err := twitch.GetUsers(&helix.UsersParams{IDs: batch})
+		if err == nil {
+			err = helixError(&res.ResponseCommon)
+		}
+		if err != nil {
+			return err
+		}
+		for _, user := range batch { // users missing from the response are cached too, so aren't looked up every poll
+			avatars[user] = avatar{"", time.Now()}
+		}
+		for _, u := range res.Data.Users {
+			avatars[u.ID] = avatar{u.ProfileImageURL, time.Now()}
+		}
+		return nil
+	})
+	if err != nil {
+		Log.Insta <- fmt.Sprintf("x | <p : %s", err)
+	}
+	for user, s := range streams { // set on copies: a stream re-sent on an event is already being read by agents
+		if url := avatars[user].url; url != s.avatar {
+			withAvatar := *s
+			withAvatar.avatar = url
+			streams[user] = &withAvatar
+		}
+	}
+}
+
+// reinterprets the HTTP error of a Helix response as an actual error (nil if none); a 401 triggers re-auth on the next call
+func helixError(res *helix.ResponseCommon) error {
+	if res.StatusCode == 200 {
+		return nil
+	}
+	if res.StatusCode == 401 {
+		auth.Invalidate()
+	}
+	return fmt.Errorf("HTTP %d: %s", res.StatusCode, res.ErrorMessage)
+}
+
+// calls f on successive batches of at most 100 items (the most Helix endpoints take in a list), stopping at f's first error
+func inBatches(items []string, f func(batch []string) error) error {
+	for start := 0; start < len(items); start += 100 {
+		end := start + 100
+		if end > len(items) {
+			end = len(items)
+		}
+		if err := f(items[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func contains(list []string, item string) bool {
+	for _, x := range list {
+		if x == item {
+			return true
+		}
+	}
+	return false
+}
+
+// recompile a list of raw Twitch streams into target dict format with custom stream structs
+func newStreamsFromTwitch(list []twitchStream) map[string]*stream {
+	dict := make(map[string]*stream, len(list)) // the return dict (twitch user ID → stream object)
+	for i := range list {
+		dict[list[i].UserID] = newStreamFromTwitch(&list[i])
 	}
+	return dict
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestInBatches(t *testing.T) {
+	items := make([]string, 250)
+	for i := range items {
+		items[i] = strconv.Itoa(i)
+	}
+	var sizes []int
+	err := inBatches(items, func(batch []string) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	})
+	if err != nil || len(sizes) != 3 || sizes[0] != 100 || sizes[1] != 100 || sizes[2] != 50 {
+		t.Errorf("batches of %v (error %v), want [100 100 50]", sizes, err)
+	}
+	calls, failure := 0, errors.New("HTTP 500: oops")
+	if err := inBatches(items, func([]string) error { calls++; return failure }); err != failure || calls != 1 {
+		t.Errorf("%d calls returning %v, want 1 returning the first error", calls, err)
+	}
+	if err := inBatches(nil, func([]string) error { return failure }); err != nil {
+		t.Errorf("no items: %v, want no calls", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+// msg layouts: text/template templates for a channel's stub text and the heading + body of its embeds (by msg state)
+// a layout's first line is the embed heading (author line); the rest is the body (description)
+// the rest of the embed (colour, thumbnail, footer, fields) and the state persisted in it are fixed, so any layout can be reloaded
+
+var stateNames = [4]string{"up", "expiring", "expired", "switched"} // msg state → name (for templates, config keys)
+
+var defaultStub = parseTemplate("stub", "{{.User}}: {{.Title}}")
+var defaultLayouts = [4]*template.Template{
+	parseTemplate("up", "{{.User}} {{.Wording}}\n[{{.Title}}]({{.URL}}){{with .Game}}\n{{.}}{{end}}"),
+	parseTemplate("expiring", "{{.User}} {{.Wording}}\n[{{.Title}}]({{.URL}}){{with .Game}}\n{{.}}{{end}}"),
+	parseTemplate("expired", "{{.User}} {{.Wording}}\n[{{.Title}}]({{.URL}}){{with .Game}}\n{{.}}{{end}}"),
+	parseTemplate("switched", "{{.User}} {{.Wording}} {{.SwitchedTo}}\n[{{.Title}}]({{.URL}}){{with .Game}}\n{{.}}{{end}}"),
+}
+
+var layoutFuncs = template.FuncMap{"lower": strings.ToLower, "upper": strings.ToUpper, "join": strings.Join}
+
+// a stream as templates see it
+type msgView struct {
+	User, Login, URL   string        // display name, ascii handle, channel link
+	Title, Game        string        // current title and game
+	Language           string        // broadcast language, e.g. "en"
+	Tags               []string      // freeform tags
+	Mature             bool          // flagged for mature audiences
+	Viewers, Peak, Avg int           // viewer counts (Peak/Avg accumulate over the stream)
+	Start              time.Time     // when the stream started
+	Length             time.Duration // total length inc. gaps (set once it's ended)
+	SwitchedTo, VOD    string        // game switched to (switched only); archive VOD URL (expired only, if any)
+	State, Wording     string        // msg state name (see stateNames); the channel's wording for it
+	Titles             []string      // title history, oldest first
+}
+
+// called in newMsgFromStream and newMsgStubFromStream to present a stream to templates
+func newMsgView(s *stream, state int, style *msgStyle) *msgView {
+	v := &msgView{
+		User: s.user, Login: s.login, URL: "https://twitch.tv/" + s.login,
+		Title: s.title, Game: s.game, Language: s.language, Tags: s.tags, Mature: s.mature,
+		Viewers: s.viewers, Peak: s.peak, Start: s.start, Length: s.length,
+		VOD: s.vod, State: stateNames[state], Wording: style.wording[state],
+	}
+	if s.samples != 0 {
+		v.Avg = s.viewerSum / s.samples
+	}
+	if state == 3 {
+		v.SwitchedTo = s.switchedTo
+	}
+	for _, t := range s.titles {
+		v.Titles = append(v.Titles, t.title)
+	}
+	return v
+}
+
+// runs a template; falls back to the default one if it fails (it was validated, so only on unexpected data)
+func render(t *template.Template, fallback *template.Template, v *msgView) string {
+	var out strings.Builder
+	if err := t.Execute(&out, v); err != nil {
+		Log.Insta <- fmt.Sprintf("x | template %s: %s", t.Name(), err)
+		out.Reset()
+		ExitIfError(fallback.Execute(&out, v))
+	}
+	return out.String()
+}
+
+// renders a layout into an embed heading (first line) and body (the rest)
+func renderLayout(s *stream, state int, style *msgStyle) (heading, body string) {
+	out := render(style.layouts[state], defaultLayouts[state], newMsgView(s, state, style))
+	if i := strings.IndexByte(out, '\n'); i != -1 {
+		return out[:i], out[i+1:]
+	}
+	return out, ""
+}
+
+// parses a template (fatal if invalid, naming it)
+func parseTemplate(name, text string) *template.Template {
+	t, err := template.New(name).Funcs(layoutFuncs).Parse(text)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid template %s: %s", name, strings.TrimPrefix(err.Error(), "template: ")))
+	}
+	return t
+}
+
+// a made-up stream with every field set, to try templates on
+var sampleStream = stream{
+	userID: "12345678", login: "sample_runner", user: "Sample_Runner", streamID: "87654321",
+	title: "any% PB attempts", game: "Super Mario 64", language: "en", tags: []string{"speedrun", "English"},
+	start: time.Date(2020, 6, 1, 18, 0, 0, 0, time.UTC), length: 95 * time.Minute,
+	viewers: 42, peak: 60, viewerSum: 90, samples: 2, switchedTo: "Just Chatting", vod: "https://www.twitch.tv/videos/1",
+	titles: []titleChange{{0, "warming up"}, {20 * time.Minute, "any% PB attempts"}},
+}
+
+// runs a channel's templates on sampleStream at startup (fatal if any fails or gives an empty/overlong heading or stub)
+func validateLayouts(channelID string, style *msgStyle) {
+	fail := func(name string, reason string) {
+		panic(fmt.Sprintf("Template %s of channel %s %s (with a sample stream)", name, channelID, reason))
+	}
+	var out strings.Builder
+	if err := style.stub.Execute(&out, newMsgView(&sampleStream, 0, style)); err != nil {
+		fail("stub", "fails: "+strings.TrimPrefix(err.Error(), "template: "))
+	} else if out.Len() == 0 || out.Len() > 2000 {
+		fail("stub", fmt.Sprintf("gives %d chars (needs 1–2000)", out.Len()))
+	}
+	for state, layout := range style.layouts {
+		out.Reset()
+		if err := layout.Execute(&out, newMsgView(&sampleStream, state, style)); err != nil {
+			fail(stateNames[state], "fails: "+strings.TrimPrefix(err.Error(), "template: "))
+		}
+		heading := strings.SplitN(out.String(), "\n", 2)[0]
+		if len(heading) == 0 || len(heading) > 256 {
+			fail(stateNames[state], fmt.Sprintf("gives a heading of %d chars (needs 1–256)", len(heading)))
+		}
+	}
+}
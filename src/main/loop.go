@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+// classifies reruns/restreams/24-7 loops, which would otherwise stay green forever:
+// by stream type (anything but "live"), by uptime (MAX_UPTIME), or by the same title over consecutive broadcasts (MAX_TITLE_REPEATS)
+// classified streams are kept out of normal channels and the role, and go only to loop channels (if any)
+
+const loopGap = time.Hour // max gap between consecutive broadcasts for a repeated title to count
+
+var maxUptime time.Duration            // streams up longer than this are loops (0 if unset)
+var maxTitleRepeats int                // streams with the same title over more than this many consecutive broadcasts are loops (0 if unset)
+var titleRuns = map[string]*titleRun{} // map user ID → broadcasts with the same title in a row (only touched in main thread)
+var loopUsers = map[string]bool{}      // set of user IDs last classified as loops, to log changes (only touched in main thread)
+
+type titleRun struct {
+	title     string    // the repeated title
+	streamIDs []string  // the broadcasts seen with it, in order
+	lastSeen  time.Time // when the last of them was last seen
+}
+
+// called only in newStreamFromTwitch (main thread): returns why a stream is a loop, or "" if it isn't (logs changes)
+func calcLoop(s *stream) string {
+	reason := ""
+	if s.kind != "live" && s.kind != "" { // "" means Twitch is having issues, not a rerun
+		reason = "type " + s.kind
+	} else if uptime := Clock.Since(s.start); maxUptime != 0 && uptime > maxUptime {
+		reason = "up " + uptime.Truncate(time.Minute).String()
+	} else if maxTitleRepeats != 0 && countTitleRepeats(s) > maxTitleRepeats {
+		reason = fmt.Sprintf("title repeated over %d broadcasts", maxTitleRepeats+1)
+	}
+	if (reason != "") != loopUsers[s.userID] {
+		Log.Insta <- fmt.Sprintf(". | loop %s: %s", s.login, IfThenElse(reason != "", reason, "no longer"))
+		if reason == "" {
+			delete(loopUsers, s.userID)
+		} else {
+			loopUsers[s.userID] = true
+		}
+	}
+	return reason
+}
+
+// records a snapshot of a stream in its user's title run; returns the number of consecutive broadcasts with its title
+func countTitleRepeats(s *stream) int {
+	run := titleRuns[s.userID]
+	if run == nil || run.title != s.title || s.start.Sub(run.lastSeen) > loopGap && !contains(run.streamIDs, s.streamID) {
+		run = &titleRun{title: s.title} // new run
+		titleRuns[s.userID] = run
+	}
+	if !contains(run.streamIDs, s.streamID) {
+		run.streamIDs = append(run.streamIDs, s.streamID)
+		if len(run.streamIDs) > maxTitleRepeats+1 { // no need to remember more than that
+			run.streamIDs = run.streamIDs[1:]
+		}
+	}
+	run.lastSeen = Clock.Now()
+	return len(run.streamIDs)
+}
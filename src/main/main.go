@@ -1,11 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Pyorot/streams/src/auth"
 	"github.com/Pyorot/streams/src/dir"
+	"github.com/Pyorot/streams/src/discordapi"
+	"github.com/Pyorot/streams/src/eventsub"
+	"github.com/Pyorot/streams/src/filter"
 	. "github.com/Pyorot/streams/src/utils"
 
 	"github.com/bwmarrin/discordgo"
@@ -13,30 +20,53 @@ import (
 )
 
 // main.go:   main program init and loop + dir init
-// fetch.go:  twitch auth + streams data poll
+// fetch.go:  twitch streams data poll (auth is in package auth)
+// source.go: stream source interface + replay of recorded snapshots
 // msg.go:    managing a streams channel (posting to Discord)
 // role.go:   managing a streams role (posting to Discord)
 // stream.go: stream struct and conversion/filter methods
+// loop.go:   classifying reruns/restreams/24-7 loops
+// archive.go: VOD + clips lookup for ended streams
 // utils.go:  macros for if, errors, env vars
 
-var err error                           // placeholder error
-var dirEnabled, twitchEnabled bool      // settings flags: guard some inits and parts of the main loop
-var twitch *helix.Client                // Twitch client
-var discord *discordgo.Session          // Discord client
-var filterTags, filterKeywords []string // Twitch tags and title keywords to filter by
-var blockTags, blockKeywords []string   //
-var dirLastLoad time.Time               // last time dir was loaded (0 if dir non-existent)
+var err error                                      // placeholder error
+var dirEnabled, twitchEnabled bool                 // settings flags: guard some inits and parts of the main loop
+var eventsubEnabled bool                           //
+var twitch *helix.Client                           // Twitch client
+var discord discordapi.API                         // Discord client (a session, or an in-memory fake)
+var filterTags, blockTags []string                 // Twitch tags to filter/block by
+var filterKeywords, blockKeywords []*regexp.Regexp // title keywords to filter/block by (compiled from the config syntax)
+var filterLanguages, blockLanguages []string       // broadcast languages to filter/block by
+var minViewers int                                 // streams below this many viewers are blocked (except dir users)
+var filterExpr, blockExpr *filter.Expr             // filter expressions: FILTER replaces the filter lists above, BLOCK adds to the block ones
+var dirLastLoad time.Time                          // last time dir was loaded (0 if dir non-existent)
+var sim *SimClock                                  // simulated clock, if simulating (nil otherwise)
+var endedStreams = make(map[string]string)         // user ID → stream ID of broadcasts ended by offline events (main thread only)
 
-// runs on program start
-func init() {
+// runs on program start (called by main)
+func setup() {
 	// structures to handle async inits (lists to collect tasks to await later)
 	awaitDir := make(Await, 0)
 	awaitRole := make(Await, 0)
 
 	// core (sync)
 	Env.Load()
-	discord, err = discordgo.New("Bot " + Env.GetOrExit("DISCORD"))
-	ExitIfError(err)
+	if Env.GetOrEmpty("SIMULATE") == "true" { // offline: replay on simulated time, as fast as possible
+		if Env.GetOrEmpty("DISCORD_FAKE") != "true" {
+			panic("SIMULATE requires DISCORD_FAKE (simulated time would ignore Discord's rate limits)")
+		}
+		sim = NewSimClock(replayStart(Env.GetOrExit("REPLAY_FILE")))
+		Clock = sim
+		Log.Insta <- fmt.Sprintf(". | simulating from %s", sim.Now().Format("2006-01-02 15:04:05"))
+	}
+	if Env.GetOrEmpty("DISCORD_FAKE") == "true" { // offline: in-memory channels + server stand in for Discord
+		fake := discordapi.NewFake()
+		fake.Log = func(line string) { Log.Insta <- line }
+		discord = fake
+	} else {
+		discord, err = discordgo.New("Bot " + Env.GetOrExit("DISCORD"))
+		ExitIfError(err)
+	}
 
 	// filters + icons (sync, all optional)
 	if rawTags := Env.GetOrEmpty("FILTER_TAGS"); rawTags != "" {
@@ -44,16 +74,47 @@ func init() {
 		Log.Insta <- fmt.Sprintf(". | filter tags [%d]: %s", len(filterTags), filterTags)
 	}
 	if rawKeywords := Env.GetOrEmpty("FILTER_KEYWORDS"); rawKeywords != "" {
-		filterKeywords = strings.Split(rawKeywords, ",")
-		Log.Insta <- fmt.Sprintf(". | filter keywords [%d]: %s", len(filterKeywords), filterKeywords)
+		filterKeywords = parseKeywords("FILTER_KEYWORDS", rawKeywords)
+		Log.Insta <- fmt.Sprintf(". | filter keywords [%d]: %s", len(filterKeywords), strings.Split(rawKeywords, ","))
 	}
 	if rawBlockTags := Env.GetOrEmpty("BLOCK_TAGS"); rawBlockTags != "" {
 		blockTags = strings.Split(rawBlockTags, ",")
 		Log.Insta <- fmt.Sprintf(". | block tags [%d]: %s", len(blockTags), blockTags)
 	}
 	if rawBlockKeywords := Env.GetOrEmpty("BLOCK_KEYWORDS"); rawBlockKeywords != "" {
-		blockKeywords = strings.Split(rawBlockKeywords, ",")
-		Log.Insta <- fmt.Sprintf(". | block keywords [%d]: %s", len(blockKeywords), blockKeywords)
+		blockKeywords = parseKeywords("BLOCK_KEYWORDS", rawBlockKeywords)
+		Log.Insta <- fmt.Sprintf(". | block keywords [%d]: %s", len(blockKeywords), strings.Split(rawBlockKeywords, ","))
+	}
+	if rawLanguages := Env.GetOrEmpty("FILTER_LANGUAGES"); rawLanguages != "" {
+		filterLanguages = strings.Split(rawLanguages, ",")
+		Log.Insta <- fmt.Sprintf(". | filter languages [%d]: %s", len(filterLanguages), filterLanguages)
+	}
+	if rawBlockLanguages := Env.GetOrEmpty("BLOCK_LANGUAGES"); rawBlockLanguages != "" {
+		blockLanguages = strings.Split(rawBlockLanguages, ",")
+		Log.Insta <- fmt.Sprintf(". | block languages [%d]: %s", len(blockLanguages), blockLanguages)
+	}
+	if rawMinViewers := Env.GetOrEmpty("MIN_VIEWERS"); rawMinViewers != "" {
+		minViewers, err = strconv.Atoi(rawMinViewers)
+		ExitIfError(err)
+		Log.Insta <- fmt.Sprintf(". | min viewers: %d", minViewers)
+	}
+	if rawMaxUptime := Env.GetOrEmpty("MAX_UPTIME"); rawMaxUptime != "" {
+		maxUptime, err = time.ParseDuration(rawMaxUptime)
+		ExitIfError(err)
+		Log.Insta <- fmt.Sprintf(". | max uptime: %s", maxUptime)
+	}
+	if rawMaxTitleRepeats := Env.GetOrEmpty("MAX_TITLE_REPEATS"); rawMaxTitleRepeats != "" {
+		maxTitleRepeats, err = strconv.Atoi(rawMaxTitleRepeats)
+		ExitIfError(err)
+		Log.Insta <- fmt.Sprintf(". | max title repeats: %d", maxTitleRepeats)
+	}
+	if raw := Env.GetOrEmpty("FILTER"); raw != "" {
+		filterExpr = parseFilter(raw)
+		Log.Insta <- fmt.Sprintf(". | filter: %s", filterExpr)
+	}
+	if raw := Env.GetOrEmpty("BLOCK"); raw != "" {
+		blockExpr = parseFilter(raw)
+		Log.Insta <- fmt.Sprintf(". | block: %s", blockExpr)
 	}
 	if url := Env.GetOrEmpty("MSG_ICON"); url != "" {
 		iconURL[0], iconURL[1], iconURL[2] = url, url, url
@@ -69,40 +130,67 @@ func init() {
 	dirChannel := Env.GetOrEmpty("DIR_CHANNEL")
 	if dirEnabled = dirChannel != ""; dirEnabled {
 		awaitDir.Add(dir.Init(discord))
-		dirLastLoad = time.Now()
+		dirLastLoad = Clock.Now()
 	}
 
 	// msg agents (async) [requires msg icons]
 	for _, channel := range strings.Split(Env.GetOrEmpty("MSG_CHANNELS"), ",") {
 		if channel == "" {
 			continue
-		} else if channel[0] == '+' || channel[0] == '*' {
-			msgAgents = append(msgAgents, newMsgAgent(channel[1:], channel[0] == '+'))
-			twitchEnabled = true
-		} else {
-			panic(fmt.Sprintf("First char of channel ID %s must be * or +", channel))
 		}
+		channelID := strings.TrimLeft(channel, "+*~")
+		var channelFilter *filter.Expr // channel's own filter (optional if channel has a prefix)
+		if raw := Env.GetOrEmpty("MSG_FILTER_" + channelID); raw != "" {
+			channelFilter = parseFilter(raw)
+		} else if channel == channelID {
+			panic(fmt.Sprintf("First char of channel ID %s must be *, + or ~, or it needs a MSG_FILTER_%s", channel, channelID))
+		}
+		msgAgents = append(msgAgents, newMsgAgent(channelID, channel[0] == '+', channel[0] == '~', channelFilter, parseStyle(channelID)))
+		twitchEnabled = true
 	}
 
-	// role (async) [requires dir (if used)]
+	// role settings
 	if roleID = Env.GetOrEmpty("ROLE"); roleID != "" { // if ROLE is missing, user probs doesn't want a role
 		serverID = Env.GetOrExit("SERVER") // if ROLE is there but SERVER missing, user probs forgot the server
-		awaitDir.Flush()                   // await dir init, needed for role init to identify users with role already set
-		awaitRole.Add(roleInit())          // run async task (returns channel)
 		twitchEnabled = true
 	}
+	if sim != nil && !twitchEnabled { // else run would spin on simulated time with no replay to advance it
+		panic("SIMULATE requires MSG_CHANNELS or ROLE (there's nothing to replay into)")
+	}
 
 	// twitch (sync) [requires msg agents and role, to determine if it's needed at all]
-	if twitchEnabled {
+	if replayPath := Env.GetOrEmpty("REPLAY_FILE"); twitchEnabled && replayPath != "" {
+		source = newReplaySource(replayPath) // offline: recorded snapshots stand in for Twitch
+	} else if twitchEnabled {
 		twitch, err = helix.NewClient(&helix.Options{
 			ClientID:     Env.GetOrExit("TWITCH_ID"),
 			ClientSecret: Env.GetOrExit("TWITCH_SEC"),
 		})
 		ExitIfError(err)
+		twitchClientID = Env.GetOrExit("TWITCH_ID")
+		auth.Init(twitch) // get + validate app access token
 		getStreamsParams = helix.StreamsParams{
-			GameIDs: strings.Split(Env.GetOrExit("GAME_ID"), ","), // list of games to query
-			First:   100,                                // maximum query results (limit is 100)
+			GameIDs: resolveGames(Env.GetOrEmpty("GAME_ID"), Env.GetOrEmpty("GAME_NAME")), // list of games to query
+			First:   100,                                                                  // maximum query results (limit is 100)
 		}
+		source = newHelixSource(Env.GetOrEmpty("RECORD_FILE"))
+	}
+
+	// role (async) [requires dir (if used) and twitch]
+	if roleID != "" {
+		awaitDir.Flush()          // await dir init, needed for role init to identify users with role already set
+		awaitRole.Add(roleInit()) // run async task (returns channel)
+	}
+
+	// eventsub (sync) [requires twitch]
+	if callback := Env.GetOrEmpty("EVENTSUB_CALLBACK"); twitchEnabled && callback != "" {
+		port := Env.GetOrEmpty("EVENTSUB_PORT")
+		if port == "" {
+			port = Env.GetOrExit("PORT") // Heroku-style
+		}
+		clientID := IfThenElse(twitch != nil, Env.GetOrEmpty("TWITCH_ID"), "") // replay: receive only
+		eventsub.Init(Env.GetOrExit("EVENTSUB_SECRET"), callback, port, clientID)
+		eventsubEnabled = true
 	}
 
 	// await parallel init tasks (by doing blocking reads on their returned channels; see rsp. functions)
@@ -111,46 +199,270 @@ func init() {
 	Log.Insta <- ". | initialised\n"
 }
 
-// main function (infinite loop)
+// main function
 func main() {
+	setup()
+	run()
+}
+
+// main loop (infinite, unless simulating: then it returns at the end of the replay)
+func run() {
+	var last map[string]*stream // last snapshot dispatched, which events are applied to
+	poll := Clock.After(0)      // fires when the next poll is due
 	for {
-		timeout := 15 * time.Second
-		now := time.Now()
-		// check for dir reload
-		if dirEnabled && now.Sub(dirLastLoad) >= 12*time.Hour {
-			dir.Load()
-			dirLastLoad = now
-		}
-		// fetch from Twitch and process
-		if twitchEnabled {
-			new, err := fetch() // synchronous Twitch http call
-			if err == nil {
-				Log.Bkgd <- fmt.Sprintf("< | %s", now.Format("15:04:05"))
-				// prune blocked streams
-				for user, stream := range new {
-					if dir.IsBlocked(user) || stream.filter == -1 {
-						delete(new, user)
-					}
-				}
-				// send to msg agents (filter if needed)
-				var newFiltered map[string]*stream // declare a map to subset "new" on known/filtered users
-				for _, a := range msgAgents {
-					if a.filtered { // the agents run msg(), a permanent worker coroutine thread that awaits on these channels
-						if newFiltered == nil { // lazily compute newFiltered once
-							newFiltered = subsetStreams(new)
-						}
-						a.inCh <- newFiltered
-					} else {
-						a.inCh <- new
+		select {
+		case <-poll:
+			timeout := 15 * time.Second
+			now := Clock.Now()
+			// check for dir reload
+			if dirEnabled && now.Sub(dirLastLoad) >= 12*time.Hour {
+				dir.Load()
+				dirLastLoad = now
+			}
+			// fetch from Twitch and process
+			if twitchEnabled {
+				new, err := source.fetch() // synchronous Twitch http call (or replay)
+				if err == nil {
+					Log.Bkgd <- fmt.Sprintf("< | %s", Clock.Now().Format("15:04:05")) // (simulated time moves on in fetch)
+					dropEnded(new)
+					if last != nil {
+						carryPeaks(new, last)
+						addSwitched(new, last)
 					}
+					dispatch(new)
+					last = new
+					timeout = source.interval()
+				} else if sim != nil && errors.Is(err, errEndOfReplay) { // nothing left to simulate
+					simulated, real := sim.Elapsed()
+					Log.Insta <- fmt.Sprintf(". | simulated %s in %s", simulated, real.Round(time.Millisecond))
+					Log.Insta <- "" // (flushes the line above)
+					return
 				}
-				// send to role agent
-				if roleID != "" {
-					go role(new) // async call to role(), runs as a one-off task (no return)
-				}
-				timeout = 60 * time.Second
 			}
+			poll = Clock.After(timeout)
+		case e := <-eventsub.Events:
+			if new := applyEvent(e, last); new != nil {
+				dispatch(new)
+				last = new
+			}
+		}
+	}
+}
+
+// applies an event to a copy of the last snapshot (last may still be being read by agents); nil if there's nothing to dispatch
+func applyEvent(e eventsub.Event, last map[string]*stream) map[string]*stream {
+	if last == nil {
+		return nil // nothing to reconcile against until the first poll
+	}
+	new := make(map[string]*stream, len(last)+1)
+	for user, s := range last {
+		new[user] = s
+	}
+	if e.Type == "stream.online" {
+		s, err := source.fetchUser(e.UserID) // stream info isn't in the event itself
+		if err != nil || s == nil || s.streamID == endedStreams[e.UserID] {
+			return nil // not (yet) visible in our games, or only the ended broadcast is; the next poll will reconcile
+		}
+		delete(endedStreams, e.UserID)
+		new[e.UserID] = s
+	} else {
+		if s, exists := last[e.UserID]; exists {
+			endedStreams[e.UserID] = s.streamID
+		}
+		delete(new, e.UserID)
+	}
+	return new
+}
+
+// drops from a poll's snapshot the broadcasts offline events have ended but Helix still lists (it can lag EventSub by
+// minutes, which would resume and re-end their msgs); forgets them once Helix does, or the user starts a new broadcast
+func dropEnded(new map[string]*stream) {
+	for user, streamID := range endedStreams {
+		if s, isInNew := new[user]; isInNew && s.streamID == streamID {
+			delete(new, user)
+		} else {
+			delete(endedStreams, user)
+		}
+	}
+}
+
+// sends a snapshot to msg agents and role, split into copies without blocked streams and loops, and loops alone
+// (the snapshot itself stays whole, as events are applied to it; it only gets the streams resolveAvatars replaces)
+func dispatch(snapshot map[string]*stream) {
+	// prune blocked streams, and move loops aside
+	new := make(map[string]*stream, len(snapshot))
+	loops := make(map[string]*stream)
+	for user, stream := range snapshot {
+		if dir.IsBlocked(strings.ToLower(stream.login)) || stream.filter == -1 {
+			continue
+		} else if stream.loop != "" {
+			loops[user] = stream
+		} else {
+			new[user] = stream
+		}
+	}
+	// attach profile images (looks up users not cached)
+	resolveAvatars(new)
+	resolveAvatars(loops)
+	for _, streams := range []map[string]*stream{new, loops} {
+		for user, s := range streams {
+			snapshot[user] = s
+		}
+	}
+	// send to msg agents (each gets the subset it accepts)
+	shown := make(map[string]bool) // users some channel or the role shows (whose events are worth subscribing to)
+	for _, a := range msgAgents {
+		var subset map[string]*stream
+		if a.loops { // the agents run msg(), a permanent worker coroutine thread that awaits on these channels
+			subset = subsetStreams(loops, a.accepts)
+		} else if a.acceptsAll() {
+			subset = new
+		} else {
+			subset = subsetStreams(new, a.accepts)
+		}
+		for user := range subset {
+			shown[user] = true
+		}
+		a.inCh <- subset
+	}
+	// send to role agent (switched streams count as offline)
+	if roleID != "" && sim != nil {
+		role(subsetStreams(new, func(s *stream) bool { return s.switchedTo == "" })) // simulating: time moves on only once it's done
+	} else if roleID != "" {
+		go role(subsetStreams(new, func(s *stream) bool { return s.switchedTo == "" })) // async call to role(), runs as a one-off task (no return)
+	}
+	// subscribe to their events
+	if eventsubEnabled {
+		for user, s := range new {
+			if roleID != "" && dir.Get(strings.ToLower(s.login)) != "" {
+				shown[user] = true
+			}
+		}
+		for user := range shown {
+			eventsub.Subscribe(user) // async; no-op if already subscribed
+		}
+	}
+	// simulating: await every agent being done with the snapshot (time moves on only once they are)
+	if sim != nil {
+		for _, a := range msgAgents {
+			<-a.acks
+		}
+	}
+}
+
+// carries over each stream's peak viewer count from the last snapshot (if the same broadcast), re-filtering those it raises:
+// MIN_VIEWERS and viewers terms test the peak, so a stream near a threshold doesn't flap between live and ended
+func carryPeaks(new, last map[string]*stream) {
+	for user, s := range new {
+		if old, isInLast := last[user]; isInLast && old.streamID == s.streamID && old.peak > s.peak {
+			s.peak = old.peak
+			s.filter = calcFilter(s)
+		}
+	}
+}
+
+// adds to a new snapshot the users missing from it since the last one who are still live in an untracked game, as switched
+// (copies of their last stream); stops checking a user once the switch is older than every channel's expiry window
+func addSwitched(new, last map[string]*stream) {
+	missing := make([]string, 0)
+	for user, s := range last {
+		if _, isInNew := new[user]; !isInNew && (s.switchedTo == "" || Clock.Since(s.switchedAt) < maxExpiry()) {
+			missing = append(missing, user)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+	elsewhere, err := source.fetchElsewhere(missing)
+	if err != nil {
+		return // treat them as offline
+	}
+	for user, game := range elsewhere {
+		s := *last[user]
+		if s.switchedTo == "" {
+			s.switchedAt = Clock.Now()
+		}
+		s.switchedTo = game
+		new[user] = &s
+	}
+}
+
+// compiles a comma-separated keyword list from config (fatal if a pattern is invalid, naming it)
+// each keyword is a substring, a "whole word" (or phrase), or a /regexp/; all ignore case
+func parseKeywords(key string, raw string) []*regexp.Regexp {
+	var keywords []*regexp.Regexp
+	for _, keyword := range strings.Split(raw, ",") {
+		var pattern string
+		switch {
+		case len(keyword) >= 2 && keyword[0] == '/' && keyword[len(keyword)-1] == '/':
+			pattern = keyword[1 : len(keyword)-1]
+		case len(keyword) >= 2 && keyword[0] == '"' && keyword[len(keyword)-1] == '"':
+			pattern = `(^|[^\pL\pN_])` + regexp.QuoteMeta(keyword[1:len(keyword)-1]) + `([^\pL\pN_]|$)` // not inside another word
+		default:
+			pattern = regexp.QuoteMeta(keyword)
+		}
+		if _, err := regexp.Compile(pattern); err != nil { // (compiled plain first so the error quotes it as written)
+			panic(fmt.Sprintf("Invalid keyword %s in %s: %s", keyword, key, strings.TrimPrefix(err.Error(), "error parsing regexp: ")))
+		}
+		keywords = append(keywords, regexp.MustCompile("(?i)"+pattern))
+	}
+	return keywords
+}
+
+// parses a filter expression from config (fatal if invalid, showing where)
+func parseFilter(raw string) *filter.Expr {
+	expr, err := filter.Parse(raw)
+	if err != nil {
+		panic(err.Error())
+	}
+	return expr
+}
+
+// reads a channel's msg style from config (MSG_EXPIRY_/MSG_COLOURS_/MSG_WORDING_/MSG_STUB_/MSG_LAYOUT_*_<channel ID>,
+// each defaulting separately; fatal if invalid, or if a template fails on a sample stream)
+func parseStyle(channelID string) msgStyle {
+	style := defaultStyle
+	if raw := Env.GetOrEmpty("MSG_EXPIRY_" + channelID); raw != "" {
+		style.expiry, err = time.ParseDuration(raw)
+		ExitIfError(err)
+	}
+	if raw := Env.GetOrEmpty("MSG_COLOURS_" + channelID); raw != "" {
+		colours := strings.Split(raw, ",")
+		if len(colours) != len(style.colours) {
+			panic(fmt.Sprintf("MSG_COLOURS_%s needs %d colours (up, expiring, expired, switched), not %d", channelID, len(style.colours), len(colours)))
+		}
+		for i, colour := range colours {
+			value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(colour), "#"), 16, 24)
+			if err != nil {
+				panic(fmt.Sprintf("Invalid colour %s in MSG_COLOURS_%s (should be hex, e.g. #00ff00)", colour, channelID))
+			}
+			style.colours[i] = int(value)
+		}
+	}
+	if raw := Env.GetOrEmpty("MSG_WORDING_" + channelID); raw != "" {
+		wording := strings.Split(raw, ",")
+		if len(wording) != len(style.wording) {
+			panic(fmt.Sprintf("MSG_WORDING_%s needs %d phrases (up, expiring, expired, switched), not %d", channelID, len(style.wording), len(wording)))
+		}
+		for i, phrase := range wording {
+			style.wording[i] = strings.TrimSpace(phrase)
+		}
+	}
+	var templates []string // names of custom ones (for logging)
+	if raw := Env.GetOrEmpty("MSG_STUB_" + channelID); raw != "" {
+		style.stub = parseTemplate("MSG_STUB_"+channelID, raw)
+		templates = append(templates, "stub")
+	}
+	for state, name := range stateNames {
+		key := "MSG_LAYOUT_" + strings.ToUpper(name) + "_" + channelID
+		if raw := Env.GetOrEmpty(key); raw != "" {
+			style.layouts[state] = parseTemplate(key, raw)
+			templates = append(templates, name)
 		}
-		time.Sleep(timeout)
 	}
+	validateLayouts(channelID, &style)
+	if style != defaultStyle {
+		Log.Insta <- fmt.Sprintf(". | msg style %s: %s, %06x, %q, templates %s", channelID, style.expiry, style.colours, style.wording, templates)
+	}
+	return style
 }
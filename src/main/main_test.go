@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Pyorot/streams/src/discordapi"
+	"github.com/Pyorot/streams/src/eventsub"
+)
+
+// an event about one user leaves every other stream as it was, in every channel: loops included (dispatch moves them
+// aside on a copy, so they're still in the snapshot the event is applied to)
+func TestEventKeepsOtherStreams(t *testing.T) {
+	fake := newTestDispatch(t, map[string]string{"100": "*", "200": "~"})
+	t.Cleanup(func() { endedStreams = make(map[string]string) })
+	alice, bob := testStream("1", "Alice"), testStream("2", "Bob")
+	alice.loop = "rerun"
+	last := map[string]*stream{"1": alice, "2": bob}
+	dispatch(last)
+	new := applyEvent(eventsub.Event{Type: "stream.offline", UserID: "2"}, last)
+	dispatch(new)
+	for channelID, want := range map[string]string{"100": "Bob:1", "200": "Alice:0"} {
+		if got := describeMsgs(fake, channelID); got != want {
+			t.Errorf("channel %s: msgs %s, want %s", channelID, got, want)
+		}
+	}
+	if _, exists := new["1"]; !exists {
+		t.Errorf("loop missing from the snapshot after dispatch")
+	}
+}
+
+// running agents for channels (ID → prefix) of a fake Discord, on simulated time from 10:00 (so dispatch awaits them)
+func newTestDispatch(t *testing.T, channels map[string]string) *discordapi.Fake {
+	fake := newTestDiscord(t)
+	t.Cleanup(func() { msgAgents = nil })
+	msgAgents = nil
+	for channelID, prefix := range channels {
+		msgAgents = append(msgAgents, newMsgAgent(channelID, prefix == "+", prefix == "~", nil, defaultStyle))
+	}
+	return fake
+}
+
+// a broadcast ended by an offline event stays ended while polls still list it, until the user starts a new one
+func TestPollLagsOfflineEvent(t *testing.T) {
+	t.Cleanup(func() { endedStreams = make(map[string]string) })
+	alice, bob := testStream("1", "Alice"), testStream("2", "Bob")
+	last := applyEvent(eventsub.Event{Type: "stream.offline", UserID: "1"}, map[string]*stream{"1": alice, "2": bob})
+	if _, exists := last["1"]; exists {
+		t.Fatalf("offline event didn't remove the stream")
+	}
+	for i, step := range []struct {
+		streamID string // alice's broadcast in the poll
+		want     bool   // is she in the snapshot after?
+	}{{"91", false}, {"91", false}, {"92", true}, {"91", true}} {
+		resumed := testStream("1", "Alice")
+		resumed.streamID = step.streamID
+		new := map[string]*stream{"1": resumed, "2": bob}
+		dropEnded(new)
+		if _, exists := new["1"]; exists != step.want || new["2"] != bob {
+			t.Errorf("poll %d (broadcast %s): alice in snapshot %t, want %t", i, step.streamID, exists, step.want)
+		}
+	}
+}
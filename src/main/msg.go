@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"strings"
+	"text/template"
 	"time"
 
+	"github.com/Pyorot/streams/src/filter"
 	. "github.com/Pyorot/streams/src/utils"
 
 	"github.com/bwmarrin/discordgo"
@@ -16,20 +18,25 @@ type msgAgent struct {
 	ID              int                       // ID to show in logging
 	channelID       string                    // the channel to post to
 	filtered        bool                      // does it receive (hence post) all users or only filtered/known ones?
+	filter          *filter.Expr              // channel's own filter expression, on top of the above (nil if none)
+	loops           bool                      // does it receive only loops (reruns etc.), which other agents never receive?
+	style           msgStyle                  // expiry window, colours and wording of its msgs
 	inCh            chan (map[string]*stream) // channel whence read in new data
-	streamsLive     streamEntries             // map user → stream-state for live streams
-	streamsExpiring streamEntries             // map user → stream-state for recently-ended streams
+	acks            chan (bool)               // channel posted to when done with new data (only if simulating)
+	streamsLive     streamEntries             // map user ID → stream-state for live streams
+	streamsExpiring streamEntries             // map user ID → stream-state for recently-ended streams
 }
 
 type streamEntries map[string]*streamEntry
 type streamEntry struct {
-	stream *stream // streams object (has info on stream)
-	msgID  string  // the ID of the Discord message we're managing to represent this stream
+	stream  *stream // streams object (has info on stream)
+	msgID   string  // the ID of the Discord message we're managing to represent this stream
+	sampled *stream // snapshot stream last sampled into it (events re-send the last poll's streams, which mustn't count again)
 }
 
 type command struct { // represents an action to be done on Discord
 	action rune    // 'a': add stream; 'e': edit stream info; 'r': remove stream
-	user   string  // stream username
+	user   string  // stream user ID
 	stream *stream // stream object
 }
 
@@ -37,13 +44,33 @@ var msgAgentCounter = 0              // used to generate unique IDs for agents
 var msgAgents = make([]*msgAgent, 0) // index of all agents
 var iconURL = make([]string, 3)      // static list of icon URLs for embeds, populated from env vars; indices match stream.filter values
 
+type msgStyle struct {
+	expiry  time.Duration         // how long a msg stays expiring (orange/grey) before it expires (red)
+	colours [4]int                // embed colour by msg state: 0 (up); 1 (down, expiring); 2 (down, expired); 3 (switched game, expiring)
+	wording [4]string             // author line after the user's name by msg state (the switched one is followed by the game)
+	stub    *template.Template    // text of a new msg (the push notification)
+	layouts [4]*template.Template // embed heading + body by msg state (see layout.go)
+}
+
+var defaultStyle = msgStyle{ // overridden per channel by MSG_EXPIRY_/MSG_COLOURS_/MSG_WORDING_/MSG_STUB_/MSG_LAYOUT_*_<channel ID>
+	expiry:  15 * time.Minute,
+	colours: [4]int{0x00ff00, 0xff8000, 0xff0000, 0x808080},
+	wording: [4]string{"is live", "was live", "was live", "switched to"},
+	stub:    defaultStub,
+	layouts: defaultLayouts,
+}
+
 // synchronous constructor for msgAgent; returns a ptr to a new agent
-func newMsgAgent(channelID string, filtered bool) *msgAgent {
+func newMsgAgent(channelID string, filtered bool, loops bool, channelFilter *filter.Expr, style msgStyle) *msgAgent {
 	a := &msgAgent{
 		ID:        msgAgentCounter,
 		inCh:      make(chan map[string]*stream),
+		acks:      make(chan bool, 1),
 		channelID: channelID,
 		filtered:  filtered,
+		loops:     loops,
+		filter:    channelFilter,
+		style:     style,
 	}
 	go a.run()
 	msgAgentCounter++
@@ -64,6 +91,9 @@ func (a *msgAgent) run() {
 		}
 		if a.process(data) {
 			data = nil
+			if sim != nil {
+				a.acks <- true
+			}
 		} else {
 			reset = true
 		}
@@ -79,18 +109,49 @@ func (a *msgAgent) load() {
 	ExitIfError(err)
 	// pick msgs that we'd been managing on last shutdown; register stream decoded from msg
 	for _, msg := range history {
-		if len(msg.Embeds) == 1 { // pick msgs with 1 embed
-			switch msg.Embeds[0].Color { // pick messages corresponding to open and recently-closed streams
-			case embedColours[0]:
-				s := newStreamFromMsg(msg)
-				a.streamsLive[strings.ToLower(s.user)] = &streamEntry{s, msg.ID}
-			case embedColours[1]:
-				s := newStreamFromMsg(msg)
-				a.streamsExpiring[strings.ToLower(s.user)] = &streamEntry{s, msg.ID}
-			}
+		switch msgStateOf(msg) { // pick messages corresponding to open and recently-closed streams
+		case 0:
+			s := newStreamFromMsg(msg)
+			a.streamsLive[s.key()] = &streamEntry{stream: s, msgID: msg.ID}
+		case 1, 3:
+			s := newStreamFromMsg(msg)
+			a.streamsExpiring[s.key()] = &streamEntry{stream: s, msgID: msg.ID}
 		}
 	}
-	Log.Insta <- fmt.Sprintf("%-2d| loaded [%d|%d] (%s-%-5t)", a.ID, len(a.streamsLive), len(a.streamsExpiring), a.channelID, a.filtered)
+	Log.Insta <- fmt.Sprintf("%-2d| loaded [%d|%d] (%s-%s)", a.ID, len(a.streamsLive), len(a.streamsExpiring), a.channelID, a.describe())
+}
+
+// does the agent post this stream? (all streams; only filtered/known ones; either, narrowed by its own filter)
+func (a *msgAgent) accepts(s *stream) bool {
+	if a.filtered && s.filter < 1 {
+		return false
+	}
+	return a.filter == nil || a.filter.Eval(s.subject())
+}
+
+// does the agent post every stream? (then it can share the unsubsetted snapshot)
+func (a *msgAgent) acceptsAll() bool {
+	return !a.filtered && a.filter == nil
+}
+
+// the longest expiry window of any agent (how long it's worth tracking users who switched game)
+func maxExpiry() time.Duration {
+	var max time.Duration
+	for _, a := range msgAgents {
+		if a.style.expiry > max {
+			max = a.style.expiry
+		}
+	}
+	return max
+}
+
+// summary of the agent's filter for logging
+func (a *msgAgent) describe() string {
+	desc := IfThenElse(a.filtered, "+", IfThenElse(a.loops, "~", "*"))
+	if a.filter != nil {
+		desc += " " + a.filter.String()
+	}
+	return desc
 }
 
 // one step; returns true if it reaches end, else panics (returning false)
@@ -103,25 +164,36 @@ func (a *msgAgent) process(streamsNew map[string]*stream) bool {
 		}
 	}()
 
+	// adopt msgs posted before user IDs were persisted, now that their users can be matched up
+	a.streamsLive.migrate(streamsNew)
+	a.streamsExpiring.migrate(streamsNew)
+
 	// generate command queue from new data
 	commands := make([]command, 0)    // output
 	for user := range a.streamsLive { // iterate thru old to pick removals
-		_, isInNew := streamsNew[user]
+		s, isInNew := streamsNew[user]
 		if !isInNew { // remove
 			commands = append(commands, command{'r', user, nil})
+		} else if s.switchedTo != "" { // remove (still live, in another game)
+			commands = append(commands, command{'s', user, s})
 		}
 	}
 	for user := range streamsNew { // iterate thru new to pick edits + adds
+		if streamsNew[user].switchedTo != "" {
+			continue // only ever moves a live msg to expiring (above)
+		}
 		_, isInOld := a.streamsLive[user]
-		if isInOld && streamsNew[user].title != a.streamsLive[user].stream.title { // edit if title changes
+		if isInOld && a.streamsLive[user].stream.changed(streamsNew[user]) { // edit if title, game (or broadcast) changes
 			commands = append(commands, command{'e', user, streamsNew[user]})
 		} else if !isInOld { // add
 			commands = append(commands, command{'a', user, streamsNew[user]})
+		} else {
+			a.streamsLive[user].sample(streamsNew[user]) // track without editing (shown as of last edit)
 		}
 	}
 
 	// process command queue (all commands are synchronous)
-	// msg embed colours: green = stream up; orange = stream down <15mins ago; red = stream down for good; yellow = msg while being created
+	// msg embed colours (by default): green = stream up; orange = stream down <15mins ago; grey = switched game <15mins ago; red = stream down for good; yellow = msg while being created
 	for _, cmd := range commands {
 		user, streamLatest := cmd.user, cmd.stream
 		switch cmd.action {
@@ -129,48 +201,60 @@ func (a *msgAgent) process(streamsNew map[string]*stream) bool {
 		case 'a':
 			_, exists := a.streamsExpiring[user] // is the user in expiring i.e. did eir stream go down <15mins ago
 			if !exists {                         // will create new msg, then edit in info (to avoid losing a duplicate if it fails)
-				Log.Insta <- fmt.Sprintf("%-2d| + %s", a.ID, user)
-				msgID := a.msgAdd(streamLatest)                         // create new msg
-				a.streamsLive[user] = &streamEntry{streamLatest, msgID} // register msg
+				Log.Insta <- fmt.Sprintf("%-2d| + %s", a.ID, streamLatest.login)
+				msgID := a.msgAdd(streamLatest)                             // create new msg
+				s := *streamLatest                                          // own copy: state accumulates per agent, snapshots are shared
+				a.streamsLive[user] = &streamEntry{&s, msgID, streamLatest} // register msg
 			} else { // will swap the old msg with newest orange msg (keeps greens grouped at bottom), then turns it green
 				msgID := a.streamsExpiring[user].msgID
-				maxUser, maxID := a.streamsExpiring.getExtremalEntry(+1)         // find ID of newest orange msg
-				Log.Insta <- fmt.Sprintf("%-2d| * %s ↔ %s", a.ID, user, maxUser) //
-				if maxID != msgID {                                              // if a swap even needs to be done
+				maxUser, maxID := a.streamsExpiring.getExtremalEntry(+1) // find ID of newest orange msg
+				Log.Insta <- fmt.Sprintf("%-2d| * %s ↔ %s%s", a.ID, streamLatest.login, a.streamsExpiring[maxUser].stream.login,
+					IfThenElse(a.streamsExpiring[user].stream.isNewBroadcast(streamLatest), " (new broadcast)", ""))
+				if maxID != msgID { // if a swap even needs to be done
 					a.streamsExpiring[user].msgID, a.streamsExpiring[maxUser].msgID = maxID, msgID // swap in internal state
 					a.msgEdit(a.streamsExpiring[maxUser], 1)                                       // edit older msg (to the closed stream)
 				}
-				a.streamsLive[user] = a.streamsExpiring[user]         // move msg to live
-				delete(a.streamsExpiring, user)                       //
-				a.streamsLive[user].stream.title = streamLatest.title // update stream title
+				a.streamsLive[user] = a.streamsExpiring[user] // move msg to live
+				delete(a.streamsExpiring, user)               //
+				a.streamsLive[user].take(streamLatest)        // update stream title etc. (or start over, if it's a new broadcast)
 			}
 			a.msgEdit(a.streamsLive[user], 0) // update newer msg with latest info (turns green)
 
 		case 'e':
-			Log.Insta <- fmt.Sprintf("%-2d| ~ %s", a.ID, user)
-			a.streamsLive[user].stream.title = streamLatest.title // update stream title
-			a.msgEdit(a.streamsLive[user], 0)                     // update msg
+			Log.Insta <- fmt.Sprintf("%-2d| ~ %s%s", a.ID, streamLatest.login,
+				IfThenElse(a.streamsLive[user].stream.isNewBroadcast(streamLatest), " (new broadcast)", ""))
+			a.streamsLive[user].take(streamLatest) // update stream title etc. (or start over, if it restarted between polls)
+			a.msgEdit(a.streamsLive[user], 0)      // update msg
 
-		case 'r': // will swap its msg with oldest green msg (keeps greens grouped at bottom), then turns it orange
+		case 'r', 's': // will swap its msg with oldest green msg (keeps greens grouped at bottom), then turns it orange (grey if switched)
 			msgID := a.streamsLive[user].msgID
-			minUser, minID := a.streamsLive.getExtremalEntry(-1)             // find ID of oldest green msg
-			Log.Insta <- fmt.Sprintf("%-2d| - %s ↔ %s", a.ID, user, minUser) //
-			if minID != msgID {                                              // if a swap even needs to be done
+			minUser, minID := a.streamsLive.getExtremalEntry(-1) // find ID of oldest green msg
+			if cmd.action == 'r' {
+				Log.Insta <- fmt.Sprintf("%-2d| - %s ↔ %s", a.ID, a.streamsLive[user].stream.login, a.streamsLive[minUser].stream.login)
+			} else {
+				Log.Insta <- fmt.Sprintf("%-2d| > %s ↔ %s (switched to %s)", a.ID, a.streamsLive[user].stream.login, a.streamsLive[minUser].stream.login, streamLatest.switchedTo)
+			}
+			if minID != msgID { // if a swap even needs to be done
 				a.streamsLive[user].msgID, a.streamsLive[minUser].msgID = minID, msgID // swap in internal state
 				a.msgEdit(a.streamsLive[minUser], 0)                                   // edit newer msg (to the open stream)
 			}
-			a.streamsExpiring[user] = a.streamsLive[user]                                            // move msg to expiring
-			delete(a.streamsLive, user)                                                              //
-			a.streamsExpiring[user].stream.length = time.Since(a.streamsExpiring[user].stream.start) // update stream length
-			a.msgEdit(a.streamsExpiring[user], 1)                                                    // edit older msg (now of a closed stream)
+			a.streamsExpiring[user] = a.streamsLive[user]                                             // move msg to expiring
+			delete(a.streamsLive, user)                                                               //
+			a.streamsExpiring[user].stream.length = Clock.Since(a.streamsExpiring[user].stream.start) // update stream length
+			state := 1
+			if cmd.action == 's' { // still live elsewhere
+				a.streamsExpiring[user].stream.switchedTo, state = streamLatest.switchedTo, 3
+			}
+			a.msgEdit(a.streamsExpiring[user], state) // edit older msg (now of a closed stream)
 		}
 	}
 
-	// manage expiries (clear streams that expired >15 mins ago)
+	// manage expiries (clear streams that ended longer ago than the expiry window)
 	for user, se := range a.streamsExpiring {
-		if s := se.stream; time.Since(s.start.Add(s.length)).Minutes() > 15 {
-			Log.Insta <- fmt.Sprintf("%-2d| / %s", a.ID, user)
+		if s := se.stream; Clock.Since(s.start.Add(s.length)) > a.style.expiry {
+			Log.Insta <- fmt.Sprintf("%-2d| / %s", a.ID, se.stream.login)
 			delete(a.streamsExpiring, user)
+			se.stream.vod, se.stream.clips = findArchive(se.stream) // Twitch has finished the VOD by now
 			a.msgEdit(se, 2)
 		}
 	}
@@ -179,6 +263,43 @@ func (a *msgAgent) process(streamsNew map[string]*stream) bool {
 	return true
 }
 
+// takes in a newer snapshot of the stream: the same broadcast updates it, but a new one (new stream ID) replaces it, so the
+// msg shows the new broadcast's start, stats and titles (and its VOD and clips, once it expires)
+func (se *streamEntry) take(latest *stream) {
+	if se.stream.isNewBroadcast(latest) {
+		s := *latest // own copy, as on an add
+		se.stream, se.sampled = &s, latest
+		return
+	}
+	se.stream.update(latest)
+	se.sample(latest)
+}
+
+// records the viewer count of a snapshot stream, once per snapshot (so only polls count, however many events are dispatched)
+func (se *streamEntry) sample(latest *stream) {
+	if latest != se.sampled {
+		se.stream.sample(latest.viewers)
+		se.sampled = latest
+	}
+}
+
+// re-keys entries loaded from legacy msgs (keyed by login, see stream.key) to the user ID of the matching new stream
+func (m streamEntries) migrate(streamsNew map[string]*stream) {
+	for key, se := range m {
+		if se.stream.userID != "" {
+			continue
+		}
+		for userID, s := range streamsNew {
+			if strings.EqualFold(s.login, se.stream.login) {
+				se.stream.userID = userID
+				delete(m, key)
+				m[userID] = se
+				break
+			}
+		}
+	}
+}
+
 // finds the oldest/newest msg in a (non-empty) m msg map
 func (m streamEntries) getExtremalEntry(sign int) (string, string) {
 	var extUser, extID string
@@ -198,9 +319,9 @@ func (m streamEntries) getExtremalEntry(sign int) (string, string) {
 func (a *msgAgent) msgAdd(s *stream) (msgID string) {
 	msgOut, err := discord.ChannelMessageSendComplex(
 		a.channelID,
-		newMsgStubFromStream(s),
+		newMsgStubFromStream(s, &a.style),
 	)
-	time.Sleep(time.Second) // avoid 5 posts / 5s rate limit
+	Clock.Sleep(time.Second) // avoid 5 posts / 5s rate limit
 	if err != nil {
 		Log.Insta <- fmt.Sprintf("x | m%d+: %s", a.ID, err)
 		panic(err) // failed add = must reload state (don't know if msg posted or not)
@@ -209,7 +330,7 @@ func (a *msgAgent) msgAdd(s *stream) (msgID string) {
 	}
 }
 
-// blocking http req to edit msg (retry until successful)
+// blocking http req to edit msg (retry until successful, or until Discord rejects it)
 func (a *msgAgent) msgEdit(se *streamEntry, state int) {
 	emptyString := " "
 	for {
@@ -217,16 +338,25 @@ func (a *msgAgent) msgEdit(se *streamEntry, state int) {
 			Channel: a.channelID,
 			ID:      se.msgID,
 			Content: &emptyString,
-			Embed:   newMsgFromStream(se.stream, state),
+			Embed:   newMsgFromStream(se.stream, state, &a.style),
 		})
-		time.Sleep(time.Second) // avoid 5 posts / 5s rate limit
+		Clock.Sleep(time.Second) // avoid 5 posts / 5s rate limit
 		if err != nil {
 			Log.Insta <- fmt.Sprintf("x | m%d~: %s", a.ID, err)
-			if err.Error()[:8] == "HTTP 404" { // special deadlock avoidance in case a discord message ID gets lost (yes, that happened)
+			if status := httpStatus(err); status == 404 { // special deadlock avoidance in case a discord message ID gets lost (yes, that happened)
 				panic(err) // reload state (else have to reverse state changes)
+			} else if status >= 400 && status < 500 && status != 429 { // Discord refused the edit itself, so retrying won't help
+				return // drop it (the msg catches up on the next edit)
 			}
 		} else {
 			return
 		}
 	}
 }
+
+// status code of a failed Discord http req (0 if there's none, e.g. a network error)
+func httpStatus(err error) int {
+	var status int
+	fmt.Sscanf(err.Error(), "HTTP %d", &status) // "HTTP 404 Not Found, {...}" (discordgo.RESTError, and the fake's errors)
+	return status
+}
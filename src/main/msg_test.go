@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pyorot/streams/src/discordapi"
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+// add → remove → resume → expire, one snapshot at a time: greens stay grouped at the bottom (newest msgs), and a
+// resumed stream takes the newest orange msg
+func TestProcessSwaps(t *testing.T) {
+	fake, a := newTestAgent(t, "100")
+	alice, bob, carol := testStream("1", "Alice"), testStream("2", "Bob"), testStream("3", "Carol")
+	steps := []struct {
+		at   int       // minutes past 10:00
+		live []*stream // snapshot
+		want string    // msgs, oldest first, as user:state
+	}{
+		{0, []*stream{alice}, "Alice:0"},
+		{1, []*stream{alice, bob}, "Alice:0 Bob:0"},
+		{2, []*stream{alice, bob, carol}, "Alice:0 Bob:0 Carol:0"},
+		{3, []*stream{alice, carol}, "Bob:1 Alice:0 Carol:0"},               // bob swaps with the oldest green
+		{4, []*stream{carol}, "Bob:1 Alice:1 Carol:0"},                      // alice's msg is already the oldest green
+		{5, []*stream{bob, carol}, "Alice:1 Bob:0 Carol:0"},                 // bob swaps with the newest orange
+		{19, []*stream{bob, carol}, "Alice:1 Bob:0 Carol:0"},                // alice has been down 15mins
+		{20, []*stream{bob, carol}, "Alice:2 Bob:0 Carol:0"},                // and now longer
+		{21, []*stream{alice, bob, carol}, "Alice:2 Bob:0 Carol:0 Alice:0"}, // so a new msg
+	}
+	for _, step := range steps {
+		sim.AdvanceTo(time.Date(2020, 6, 1, 10, step.at, 0, 0, time.UTC))
+		snapshot := make(map[string]*stream)
+		for _, s := range step.live {
+			snapshot[s.userID] = s
+		}
+		if !a.process(snapshot) {
+			t.Fatalf("10:%02d: process failed", step.at)
+		}
+		if got := describeMsgs(fake, "100"); got != step.want {
+			t.Errorf("10:%02d: msgs %s, want %s", step.at, got, step.want)
+		}
+	}
+}
+
+// an agent reloads the msgs it was managing (e.g. after a restart), and carries on from them
+func TestLoadResumes(t *testing.T) {
+	fake, a := newTestAgent(t, "100")
+	alice, bob := testStream("1", "Alice"), testStream("2", "Bob")
+	a.process(map[string]*stream{"1": alice, "2": bob})
+	sim.AdvanceTo(time.Date(2020, 6, 1, 10, 5, 0, 0, time.UTC))
+	a.process(map[string]*stream{"2": bob})
+	a.load()
+	if len(a.streamsLive) != 1 || len(a.streamsExpiring) != 1 {
+		t.Fatalf("loaded [%d|%d], want [1|1]", len(a.streamsLive), len(a.streamsExpiring))
+	}
+	sim.AdvanceTo(time.Date(2020, 6, 1, 10, 6, 0, 0, time.UTC))
+	a.process(map[string]*stream{"1": alice, "2": bob})
+	if got, want := describeMsgs(fake, "100"), "Alice:0 Bob:0"; got != want {
+		t.Errorf("msgs %s, want %s", got, want)
+	}
+}
+
+// an agent for a channel of a fake Discord, on simulated time from 10:00 (not running: tests call process directly)
+func newTestAgent(t *testing.T, channelID string) (*discordapi.Fake, *msgAgent) {
+	fake := newTestDiscord(t)
+	a := &msgAgent{channelID: channelID, style: defaultStyle}
+	a.load()
+	return fake, a
+}
+
+// a fake Discord, on simulated time from 10:00
+func newTestDiscord(t *testing.T) *discordapi.Fake {
+	oldClock, oldDiscord := Clock, discord
+	t.Cleanup(func() { Clock, discord, sim = oldClock, oldDiscord, nil })
+	fake := discordapi.NewFake()
+	discord = fake
+	sim = NewSimClock(time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC))
+	Clock = sim
+	return fake
+}
+
+// a stream that started at 9:00 (as newStreamFromTwitch makes)
+func testStream(userID, user string) *stream {
+	login, title := strings.ToLower(user), user+"'s stream"
+	return &stream{
+		userID: userID, login: login, user: user, streamID: "9" + userID, title: title, titles: []titleChange{{0, title}},
+		start:     time.Date(2020, 6, 1, 9, 0, 0, 0, time.UTC),
+		thumbnail: "https://static-cdn.jtvnw.net/previews-ttv/live_user_" + login + "-440x248.jpg",
+		gameID:    "2692", game: "Super Mario 64", viewers: 10, peak: 10, viewerSum: 10, samples: 1, kind: "live",
+	}
+}
+
+// the msgs in a channel, oldest first, as user:state
+func describeMsgs(fake *discordapi.Fake, channelID string) string {
+	var out []string
+	for _, msg := range fake.Messages(channelID) {
+		out = append(out, fmt.Sprintf("%s:%d", strings.Fields(msg.Embeds[0].Author.Name)[0], msgStateOf(&msg)))
+	}
+	return strings.Join(out, " ")
+}
+
+// viewers are sampled once per poll snapshot, however many times events re-send it
+func TestSampleOncePerSnapshot(t *testing.T) {
+	_, a := newTestAgent(t, "100")
+	alice, bob := testStream("1", "Alice"), testStream("2", "Bob")
+	a.process(map[string]*stream{"1": alice})
+	alice = testStream("1", "Alice")
+	alice.viewers = 40
+	a.process(map[string]*stream{"1": alice})           // poll
+	a.process(map[string]*stream{"1": alice, "2": bob}) // event: bob came online
+	a.process(map[string]*stream{"1": alice})           // event: bob went offline
+	if s := a.streamsLive["1"].stream; s.samples != 2 || s.viewerSum != 50 || s.peak != 40 {
+		t.Errorf("samples %d, sum %d, peak %d; want 2, 50, 40", s.samples, s.viewerSum, s.peak)
+	}
+}
+
+// a new broadcast (new stream ID) takes over the user's msg, live or expiring, but starts over: start, stats and titles
+// are its own; the same broadcast resuming keeps them
+func TestNewBroadcastStartsOver(t *testing.T) {
+	_, a := newTestAgent(t, "100")
+	first := testStream("1", "Alice")
+	first.viewers, first.peak, first.viewerSum = 50, 50, 50
+	resumed := *first
+	resumed.title, resumed.viewers = "back", 30
+	second := testStream("1", "Alice")
+	second.streamID, second.start, second.title = "92", time.Date(2020, 6, 1, 10, 3, 0, 0, time.UTC), "new day"
+	third := *second
+	third.streamID = "93"
+	steps := []struct {
+		at      int     // minutes past 10:00
+		live    *stream // alice's stream (nil if offline)
+		start   int     // hour:minute of the start wanted, as h*100+m
+		peak    int     // wanted
+		samples int     // wanted
+		titles  int     // wanted
+	}{
+		{0, first, 900, 50, 1, 1},
+		{1, nil, 900, 50, 1, 1},
+		{2, &resumed, 900, 50, 2, 2}, // same broadcast: resumes
+		{3, nil, 900, 50, 2, 2},      //
+		{4, second, 1003, 10, 1, 1},  // new broadcast: starts over
+		{5, &third, 1003, 10, 1, 1},  // restarted between polls: starts over (live)
+	}
+	for _, step := range steps {
+		sim.AdvanceTo(time.Date(2020, 6, 1, 10, step.at, 0, 0, time.UTC))
+		snapshot := map[string]*stream{}
+		if step.live != nil {
+			snapshot["1"] = step.live
+		}
+		a.process(snapshot)
+		se := a.streamsLive["1"]
+		if se == nil {
+			se = a.streamsExpiring["1"]
+		}
+		s := se.stream
+		if start := s.start.Hour()*100 + s.start.Minute(); start != step.start || s.peak != step.peak || s.samples != step.samples || len(s.titles) != step.titles {
+			t.Errorf("10:%02d: start %d, peak %d, samples %d, titles %d; want %d, %d, %d, %d",
+				step.at, start, s.peak, s.samples, len(s.titles), step.start, step.peak, step.samples, step.titles)
+		}
+		if se.msgID != "200000000000000000" {
+			t.Errorf("10:%02d: msg %s, want the first one", step.at, se.msgID)
+		}
+	}
+}
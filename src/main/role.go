@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	dir "github.com/Pyorot/streams/src/dir"
@@ -10,9 +12,15 @@ import (
 
 // provides a task, role(), to call to process updates to roles
 
-var roleID string                   // Discord ID of the role
-var serverID string                 // Discord ID of the server the role belongs to
-var roles = make(map[string]string) // map of managed users (Twitch username → Discord userID). inclusion = has role
+var roleID string                       // Discord ID of the role
+var serverID string                     // Discord ID of the server the role belongs to
+var roles = make(map[string]roleHolder) // map of managed users (Twitch user ID → holder). inclusion = has role
+var roleLock sync.Mutex                 // serialises role() calls (events can dispatch while one is still running)
+
+type roleHolder struct {
+	login     string // Twitch login (for dir + logging)
+	discordID string // Discord user ID
+}
 
 // non-blocking http req to load all users and register to state via inverse look-up
 func roleInit() chan (bool) {
@@ -21,8 +29,9 @@ func roleInit() chan (bool) {
 		// create inverse dict to identify for each discord user if eir stream is still up
 		inverseDir := dir.Inverse()
 		// find every discord member with the role and register using dir
-		next := ""     // ID of next user, used to chain sync calls (endpoint has 1000-result limit)
-		userCount := 0 // will track total users detected
+		next := ""                         // ID of next user, used to chain sync calls (endpoint has 1000-result limit)
+		userCount := 0                     // will track total users detected
+		holders := make(map[string]string) // role holders found in dir (Twitch login → Discord userID)
 		for {
 			users, err := discord.GuildMembers(serverID, next, 1000)
 			ExitIfError(err)
@@ -36,9 +45,9 @@ func roleInit() chan (bool) {
 						if role == roleID { // if managed role is in user's roles
 							twitchHandle, isInDir := inverseDir[user.User.ID]
 							if isInDir {
-								roles[twitchHandle] = user.User.ID
-							} else { // if unknown user, trigger role-removal by registering under unique non-existent handle
-								roles[user.User.ID] = user.User.ID
+								holders[twitchHandle] = user.User.ID
+							} else { // if unknown user, trigger role-removal by registering under unique non-existent user ID
+								roles[user.User.ID] = roleHolder{user.User.ID, user.User.ID}
 							}
 							break
 						}
@@ -46,6 +55,15 @@ func roleInit() chan (bool) {
 				}
 			}
 		}
+		// key holders by Twitch user ID (as streams are); unresolvable logins are treated as unknown users
+		userIDs := resolveLogins(holders)
+		for login, discordID := range holders {
+			if userID, exists := userIDs[login]; exists {
+				roles[userID] = roleHolder{login, discordID}
+			} else {
+				roles[discordID] = roleHolder{login, discordID}
+			}
+		}
 		Log.Insta <- fmt.Sprintf("r | init [%d/%d] (%s)", len(roles), userCount, serverID)
 		res <- true
 	}()
@@ -54,22 +72,26 @@ func roleInit() chan (bool) {
 
 // non-blocking parallelised call to all role additions/removals, handling return values
 func role(new map[string]*stream) {
+	roleLock.Lock()
+	defer roleLock.Unlock()
 	// call external actions
 	addsCh := make(map[string]chan (bool))    // list of chans to await additions
 	removesCh := make(map[string]chan (bool)) // list of chans to await removals
-	for user := range roles {                 // iterate thru old to pick removals
+	added := make(map[string]roleHolder)      // holders to register if additions succeed
+	for user, holder := range roles {         // iterate thru old to pick removals
 		_, isInNew := new[user]
 		if !isInNew {
-			Log.Insta <- "r | - " + user
-			removesCh[user] = roleRemove(roles[user]) // async call; registers await chan
+			Log.Insta <- "r | - " + holder.login
+			removesCh[user] = roleRemove(holder.discordID) // async call; registers await chan
 		}
 	}
-	for user := range new { // iterate thru new to pick additions
+	for user, s := range new { // iterate thru new to pick additions
 		_, isInOld := roles[user]
-		userID := dir.Get(user) // look-up Twitch username in dir (skip user if not found)
-		if !isInOld && userID != "" {
-			Log.Insta <- "r | + " + user
-			addsCh[user] = roleAdd(userID) // async call; registers await chan
+		discordID := dir.Get(strings.ToLower(s.login)) // look-up Twitch login in dir (skip user if not found)
+		if !isInOld && discordID != "" {
+			Log.Insta <- "r | + " + s.login
+			added[user] = roleHolder{s.login, discordID}
+			addsCh[user] = roleAdd(discordID) // async call; registers await chan
 		}
 	}
 
@@ -81,7 +103,7 @@ func role(new map[string]*stream) {
 	}
 	for user, ch := range addsCh {
 		if <-ch {
-			roles[user] = dir.Get(user)
+			roles[user] = added[user]
 		}
 	}
 
@@ -93,7 +115,7 @@ func roleAdd(userID string) chan (bool) {
 	res := make(chan (bool), 1)
 	go func() {
 		err := discord.GuildMemberRoleAdd(serverID, userID, roleID)
-		time.Sleep(1 * time.Second) // avoid 5 posts / 5s rate limit
+		Clock.Sleep(1 * time.Second) // avoid 5 posts / 5s rate limit
 		if err != nil {
 			Log.Insta <- fmt.Sprintf("x | r+ | %s : %s", userID, err)
 		}
@@ -107,7 +129,7 @@ func roleRemove(userID string) chan (bool) {
 	res := make(chan (bool), 1)
 	go func() {
 		err := discord.GuildMemberRoleRemove(serverID, userID, roleID)
-		time.Sleep(1 * time.Second) // avoid 5 posts / 5s rate limit
+		Clock.Sleep(1 * time.Second) // avoid 5 posts / 5s rate limit
 		if err != nil {
 			Log.Insta <- fmt.Sprintf("x | r- | %s : %s", userID, err)
 		}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Pyorot/streams/src/dir"
+	"github.com/Pyorot/streams/src/discordapi"
+	. "github.com/Pyorot/streams/src/utils"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// holders are registered from the server on init (unknown ones to be removed), then synced to who's live
+func TestRole(t *testing.T) {
+	oldClock, oldDiscord := Clock, discord
+	t.Cleanup(func() {
+		Clock, discord, serverID, roleID, roles = oldClock, oldDiscord, "", "", make(map[string]roleHolder)
+	})
+	fake := discordapi.NewFake()
+	discord, Clock = fake, NewSimClock(testStream("1", "Alice").start)
+	serverID, roleID = "10", "20"
+	fake.Post("dir", "300000000000000000", &discordgo.MessageSend{Content: "dir\n500 alice\n600 bob"})
+	os.Setenv("DIR_CHANNEL", "dir")
+	<-dir.Init(fake)
+	fake.AddMember("10", "500")
+	fake.AddMember("10", "600", "20", "30") // in dir, but offline (and not resolvable offline)
+	fake.AddMember("10", "900", "20")       // not in dir
+	<-roleInit()
+
+	role(map[string]*stream{"1": testStream("1", "Alice")})
+	for userID, want := range map[string][]string{"500": {"20"}, "600": {"30"}, "900": {}} {
+		if got := fake.Roles("10", userID); !reflect.DeepEqual(got, want) {
+			t.Errorf("roles of %s: %v, want %v", userID, got, want)
+		}
+	}
+	if len(roles) != 1 || roles["1"].discordID != "500" {
+		t.Errorf("holders %v, want alice only", roles)
+	}
+}
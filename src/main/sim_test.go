@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Pyorot/streams/src/discordapi"
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+// replays testdata/replay.jsonl on simulated time: alice and bob go live at 10:00 and down at 10:02; alice resumes
+// 10:10–10:12; both end up expired (red), with lengths as recorded, however long the agent's sleeps are
+func TestSimulateToExpired(t *testing.T) {
+	fake := simulate(t, "testdata/replay.jsonl", "100")
+	if want := time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC); !sim.Now().Equal(want) {
+		t.Errorf("simulation ended at %s, want %s (the last snapshot)", sim.Now(), want)
+	}
+	msgs := fake.Messages("100")
+	if len(msgs) != 2 {
+		t.Fatalf("got %d msgs, want 2", len(msgs))
+	}
+	lengths := map[string]string{"Alice": "1h12m", "Bob": "1h2m"}
+	for _, msg := range msgs {
+		embed := msg.Embeds[0]
+		user := strings.Fields(embed.Author.Name)[0]
+		if embed.Color != defaultStyle.colours[2] {
+			t.Errorf("%s: colour %06x, want %06x (expired)", user, embed.Color, defaultStyle.colours[2])
+		}
+		if embed.Footer.Text != lengths[user] {
+			t.Errorf("%s: length %s, want %s", user, embed.Footer.Text, lengths[user])
+		}
+	}
+}
+
+// runs a replay to its end on simulated time, into a fake Discord with one unfiltered msg channel; returns the fake
+func simulate(t *testing.T, path string, channelID string) *discordapi.Fake {
+	oldClock, oldDiscord := Clock, discord
+	t.Cleanup(func() {
+		Clock, discord, sim, source, msgAgents, twitchEnabled = oldClock, oldDiscord, nil, nil, nil, false
+	})
+	fake := discordapi.NewFake()
+	discord = fake
+	sim = NewSimClock(replayStart(path))
+	Clock = sim
+	source = newReplaySource(path)
+	twitchEnabled = true
+	msgAgents = []*msgAgent{newMsgAgent(channelID, false, false, nil, defaultStyle)}
+	run()
+	return fake
+}
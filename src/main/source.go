@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/Pyorot/streams/src/utils"
+)
+
+// a source of stream snapshots for the main loop: live from Twitch (helixSource, fetch.go) or recorded (replaySource)
+
+type streamSource interface {
+	fetch() (map[string]*stream, error)                         // blocking call to get the current snapshot (twitch user ID → stream object)
+	fetchUser(userID string) (*stream, error)                   // blocking call to get one user's stream (nil if not live in tracked games)
+	fetchElsewhere(userIDs []string) (map[string]string, error) // blocking call to find which users are live in untracked games (user ID → game name)
+	interval() time.Duration                                    // time to wait after a successful fetch before the next one
+}
+
+var source streamSource // the source in use, initialised in main.go:setup()
+
+var errEndOfReplay = errors.New("end of replay") // (a simulation stops on it)
+
+// one recorded snapshot: a line in a record/replay file (JSON lines)
+type snapshot struct {
+	Time    time.Time      `json:"time"`    // when it was fetched
+	Streams []twitchStream `json:"streams"` // raw results from all pages
+}
+
+// offline stream source: reads back snapshots recorded by helixSource, one per fetch
+type replaySource struct {
+	path    string         // file being replayed (for logging)
+	scanner *bufio.Scanner // line iterator over the file
+	line    int            // number of snapshots read so far
+	current []twitchStream // latest snapshot read (for fetchUser)
+}
+
+// synchronous constructor for replaySource
+func newReplaySource(path string) *replaySource {
+	file, err := os.Open(path)
+	ExitIfError(err)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // snapshots of big games are long lines
+	Log.Insta <- fmt.Sprintf(". | replaying snapshots from %s", path)
+	return &replaySource{path: path, scanner: scanner}
+}
+
+// synchronous read of the time of the first snapshot in a replay file (where a simulation starts)
+func replayStart(path string) time.Time {
+	file, err := os.Open(path)
+	ExitIfError(err)
+	defer file.Close()
+	var snap struct {
+		Time time.Time `json:"time"`
+	}
+	ExitIfError(json.NewDecoder(file).Decode(&snap))
+	return snap.Time
+}
+
+// non-blocking read of the next snapshot; errors once the file is exhausted
+func (r *replaySource) fetch() (map[string]*stream, error) {
+	if !r.scanner.Scan() {
+		err := r.scanner.Err()
+		if err == nil {
+			err = fmt.Errorf("%w %s after %d snapshots", errEndOfReplay, r.path, r.line)
+		}
+		Log.Insta <- fmt.Sprintf("x | < : %s", err)
+		return nil, err
+	}
+	r.line++
+	var snap snapshot
+	if err := json.Unmarshal(r.scanner.Bytes(), &snap); err != nil {
+		err = fmt.Errorf("replay %s:%d: %s", r.path, r.line, err)
+		Log.Insta <- fmt.Sprintf("x | < : %s", err)
+		return nil, err
+	}
+	if sim != nil {
+		sim.AdvanceTo(snap.Time) // simulated time follows the recording, poll by poll
+	}
+	Log.Bkgd <- fmt.Sprintf("< | replay %d (%s)", r.line, snap.Time.Format("15:04:05"))
+	r.current = snap.Streams
+	return newStreamsFromTwitch(snap.Streams), nil
+}
+
+// replays at the live poll rate, so expiries etc. behave as they did when recorded
+func (r *replaySource) interval() time.Duration {
+	return pollInterval
+}
+
+// non-blocking look-up of a user in the latest snapshot read
+func (r *replaySource) fetchUser(userID string) (*stream, error) {
+	for i := range r.current {
+		if r.current[i].UserID == userID {
+			return newStreamFromTwitch(&r.current[i]), nil
+		}
+	}
+	return nil, nil
+}
+
+// recordings only cover tracked games, so users missing from them look offline
+func (r *replaySource) fetchElsewhere(userIDs []string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
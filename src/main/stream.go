@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Pyorot/streams/src/dir"
+	"github.com/Pyorot/streams/src/filter"
 	. "github.com/Pyorot/streams/src/utils"
 
 	"github.com/bwmarrin/discordgo"
@@ -14,30 +18,78 @@ import (
 
 // represents a current stream, for both live updates and internal state
 type stream struct {
-	user      string        // Twitch handle (set on creation, not updated in internal state)
-	urlUser   string        // Twitch handle for URL (set on creation, not updated in internal state)
-	title     string        // stream title (set on creation, updated)
-	start     time.Time     // stream started at (set on creation, not updated)
-	length    time.Duration // total stream length inc. gaps (not set on creation, updated on stream going offline)
-	thumbnail string        // stream thumbnail URL (set on creation, not updated)
-	filter    int           // 2 (user in Twicord); 1 (tag/keyword match); 0 (else) (set on creation, not updated)
+	userID     string        // Twitch user ID: immutable, so keys all state (set on creation, not updated)
+	login      string        // Twitch login: ascii handle for URLs + dir (set on creation, not updated in internal state)
+	user       string        // Twitch display name (set on creation, not updated in internal state)
+	streamID   string        // Twitch stream ID: new per broadcast (set on creation, updated)
+	title      string        // stream title (set on creation, updated)
+	start      time.Time     // stream started at (set on creation, not updated)
+	length     time.Duration // total stream length inc. gaps (not set on creation, updated on stream going offline)
+	thumbnail  string        // stream thumbnail URL (set on creation, not updated)
+	filter     int           // 2 (user in Twicord); 1 (tag/keyword match); 0 (else) (set on creation, not updated)
+	viewers    int           // current viewer count (set on creation, updated every snapshot)
+	language   string        // broadcast language, e.g. "en" (set on creation, updated)
+	mature     bool          // flagged for mature audiences (set on creation, updated)
+	kind       string        // stream type: "live", or e.g. "" if Twitch is having issues (set on creation, updated)
+	tags       []string      // freeform tags (set on creation, updated)
+	tagIDs     []string      // legacy tag UUIDs (set on creation from Twitch only, not persisted; used by the filter)
+	gameID     string        // Twitch game ID (set on creation, updated)
+	game       string        // Twitch game name (set on creation, updated)
+	loop       string        // why it's a rerun/restream/24-7 loop, or "" (set on creation from Twitch only, not persisted; used in dispatch)
+	vod        string        // URL of the archive VOD (not set on creation, set on expiry; shown in expired msgs only)
+	clips      []helix.Clip  // most viewed clips made during the stream (as vod)
+	peak       int           // peak viewer count (set on creation, accumulated every snapshot)
+	viewerSum  int           // sum of viewer counts over snapshots, for the average (as peak)
+	samples    int           // number of snapshots accumulated (as peak)
+	titles     []titleChange // title history, latest last (set on creation, appended on title change, bounded)
+	switchedTo string        // untracked game the user switched to while live, or "" (set by main on a copy of the last snapshot, updated)
+	switchedAt time.Time     // when the switch was first seen (as switchedTo, not persisted)
+	avatar     string        // profile image URL (set by main after creation, updated)
 }
 
-var embedColours = [3]int{0x00ff00, 0xff8000, 0xff0000} // index = stream state: 0 (up); 1 (down, expiring); 2 (down, expired)
+type titleChange struct {
+	offset time.Duration // since stream start
+	title  string        //
+}
+
+const titlesMax = 5 // max length of title history (oldest dropped)
+
+const stateMax = 1900 // max length of encoded state (Discord rejects embed URLs over 2048, which also hold "https://twitch.tv/<login>?" and the msg state)
 
 // called only in fetch() to generate live updates from incoming new data
-func newStreamFromTwitch(r *helix.Stream) *stream {
+func newStreamFromTwitch(r *twitchStream) *stream {
 	indexUserStart := strings.LastIndexByte(r.ThumbnailURL, '/') + 11
 	indexUserEnd := strings.LastIndexByte(r.ThumbnailURL, '-')
 	s := &stream{
+		userID:    r.UserID,
+		login:     r.UserLogin,
 		user:      r.UserName,
-		urlUser:   r.ThumbnailURL[indexUserStart:indexUserEnd], // only way to get ascii name of JP users lmao
+		streamID:  r.ID,
 		title:     r.Title,
 		start:     r.StartedAt,
 		thumbnail: r.ThumbnailURL[:indexUserEnd+1] + "440x248.jpg",
-		filter:    calcFilter(r),
+		viewers:   r.ViewerCount,
+		language:  r.Language,
+		mature:    r.IsMature,
+		kind:      r.Type,
+		tags:      r.Tags,
+		tagIDs:    r.TagIDs,
+		gameID:    r.GameID,
+		game:      r.GameName,
+		peak:      r.ViewerCount,
+		viewerSum: r.ViewerCount,
+		samples:   1,
+		titles:    []titleChange{{0, r.Title}},
 		// length is not set until stream goes down
 	}
+	if s.login == "" { // recorded before user_login was decoded: only other way to get ascii name of JP users lmao
+		s.login = r.ThumbnailURL[indexUserStart:indexUserEnd]
+	}
+	if s.game == "" { // recorded before game_name was decoded
+		s.game = gameNames[s.gameID]
+	}
+	s.filter = calcFilter(s)
+	s.loop = calcLoop(s)
 	return s
 }
 
@@ -45,73 +97,294 @@ func newStreamFromTwitch(r *helix.Stream) *stream {
 // note: length calc (msg.run() remove) will be wrong if stream went down while program off
 func newStreamFromMsg(msg *discordgo.Message) *stream {
 	var s stream
-	s.user = msg.Embeds[0].Author.Name[:strings.IndexByte(msg.Embeds[0].Author.Name, ' ')]        // first word in author
-	s.urlUser = msg.Embeds[0].Author.URL[strings.LastIndexByte(msg.Embeds[0].Author.URL, '/')+1:] // last part of url
-	s.title = msg.Embeds[0].Description[1:strings.IndexByte(msg.Embeds[0].Description, ']')]      // "[user](link)" in description
+	authorURL, err := url.Parse(msg.Embeds[0].Author.URL) // "https://twitch.tv/<login>?<state>"
+	ExitIfError(err)
+	s.login = strings.TrimPrefix(authorURL.Path, "/")
+	decodeState(&s, authorURL.Query()) // empty for msgs posted before state was persisted
+	if len(s.titles) != 0 {            // exact, even if the title has a "]"
+		s.title = s.titles[len(s.titles)-1].title
+	}
+	if s.user == "" { // msg posted before the name was persisted, so in the default layout: parse it
+		s.user = msg.Embeds[0].Author.Name[:strings.IndexByte(msg.Embeds[0].Author.Name, ' ')] // first word in author
+		if s.title == "" {
+			s.title = msg.Embeds[0].Description[1:strings.IndexByte(msg.Embeds[0].Description, ']')] // "[user](link)" in description
+		}
+		if i := strings.IndexByte(msg.Embeds[0].Description, '\n'); i != -1 { // "\n<game>" after it
+			s.game = msg.Embeds[0].Description[i+1:]
+		}
+	}
 	s.start, err = time.Parse("2006-01-02T15:04:05-07:00", msg.Embeds[0].Timestamp)
 	ExitIfError(err)
-	if msg.Embeds[0].Footer != nil && msg.Embeds[0].Footer.Text != "" {
+	if msg.Embeds[0].Footer != nil && msg.Embeds[0].Footer.Text != "" && msgStateOf(msg) != 0 { // up shows viewers
 		s.length, err = time.ParseDuration(msg.Embeds[0].Footer.Text) // relying on go default format
 		ExitIfError(err)
 	}
 	if msg.Embeds[0].Thumbnail != nil {
 		s.thumbnail = msg.Embeds[0].Thumbnail.URL
 	}
+	filterIcon := msg.Embeds[0].Author.IconURL // msgs posted before avatars had the filter icon as author icon
+	if msg.Embeds[0].Footer != nil && msg.Embeds[0].Footer.IconURL != "" {
+		filterIcon, s.avatar = msg.Embeds[0].Footer.IconURL, msg.Embeds[0].Author.IconURL
+	} else if !contains(iconURL, filterIcon) { // avatar, and no filter icons configured
+		filterIcon, s.avatar = "", msg.Embeds[0].Author.IconURL
+	}
 	for i, URL := range iconURL { // will pick highest matching i; doesn't matter
-		if msg.Embeds[0].Author.IconURL == URL {
+		if filterIcon == URL {
 			s.filter = i
 		}
 	}
 	return &s
 }
 
-// called only in msgAdd to generate a basic push-notification embed; gets edited by msgEdit right after
-func newMsgStubFromStream(s *stream) *discordgo.MessageSend {
-	return &discordgo.MessageSend{Content: fmt.Sprintf("%s: %s", s.user, s.title)}
+// key of the stream in state maps: the user ID, or for msgs posted before it was persisted, the login
+// (which can't collide, as user IDs are numeric)
+func (s *stream) key() string {
+	return IfThenElse(s.userID != "", s.userID, strings.ToLower(s.login))
+}
+
+// copies the properties that change during a stream from a newer snapshot of it (viewers are sampled separately)
+func (s *stream) update(latest *stream) {
+	if latest.title != s.title {
+		s.retitle(latest.title)
+	}
+	s.title, s.streamID = latest.title, latest.streamID
+	s.language, s.mature, s.kind, s.tags = latest.language, latest.mature, latest.kind, latest.tags
+	s.gameID, s.game, s.switchedTo = latest.gameID, latest.game, latest.switchedTo
+	if latest.avatar != "" { // (unless the look-up failed)
+		s.avatar = latest.avatar
+	}
+}
+
+// is a newer snapshot of the stream a different broadcast? (msgs posted before stream IDs were persisted never are)
+func (s *stream) isNewBroadcast(latest *stream) bool {
+	return s.streamID != "" && latest.streamID != s.streamID
+}
+
+// records a title change in the title history
+func (s *stream) retitle(title string) {
+	if len(s.titles) == 0 { // msg posted before title history was persisted
+		s.titles = []titleChange{{0, s.title}}
+	}
+	s.titles = append(s.titles, titleChange{Clock.Since(s.start), title})
+	if len(s.titles) > titlesMax {
+		s.titles = s.titles[len(s.titles)-titlesMax:]
+	}
 }
 
-// called only in msgEdit to generate embeds for messages
-func newMsgFromStream(s *stream, state int) *discordgo.MessageEmbed {
+// records the viewer count of a newer snapshot of the stream (without editing its msg)
+func (s *stream) sample(viewers int) {
+	s.viewers = viewers
+	if viewers > s.peak {
+		s.peak = viewers
+	}
+	s.viewerSum += viewers
+	s.samples++
+}
+
+// does a newer snapshot of the stream change its msg (viewers alone don't)?
+func (s *stream) changed(latest *stream) bool {
+	return latest.title != s.title || latest.gameID != s.gameID || latest.streamID != s.streamID
+}
+
+// called only in msgAdd to generate a basic push-notification msg (the agent's stub template); gets edited by msgEdit right after
+func newMsgStubFromStream(s *stream, style *msgStyle) *discordgo.MessageSend {
+	return &discordgo.MessageSend{Content: render(style.stub, defaultStub, newMsgView(s, 0, style))}
+}
+
+// called only in msgEdit to generate embeds for messages, in the agent's style
+func newMsgFromStream(s *stream, state int, style *msgStyle) *discordgo.MessageEmbed {
+	query := encodeState(s)
+	query.Set("state", strconv.Itoa(state)) // (read by msgStateOf)
+	heading, body := renderLayout(s, state, style)
 	return &discordgo.MessageEmbed{
 		Author: &discordgo.MessageEmbedAuthor{
-			Name:    s.user + IfThenElse(state == 0, " is live", " was live"),
-			URL:     "https://twitch.tv/" + s.urlUser,
-			IconURL: iconURL[s.filter],
+			Name:    heading,
+			URL:     "https://twitch.tv/" + s.login + "?" + query.Encode(),
+			IconURL: IfThenElse(s.avatar != "", s.avatar, iconURL[s.filter]),
 		},
-		Description: fmt.Sprintf("[%s](%s)", s.title, "https://twitch.tv/"+s.urlUser),
-		Color:       embedColours[state],
+		Description: body,
+		Color:       style.colours[state],
 		Thumbnail:   &discordgo.MessageEmbedThumbnail{URL: IfThenElse(state == 0, s.thumbnail, "")},
-		Footer:      &discordgo.MessageEmbedFooter{Text: IfThenElse(state == 0, "", strings.TrimSuffix(s.length.Truncate(time.Minute).String(), "0s"))},
+		Footer:      &discordgo.MessageEmbedFooter{IconURL: iconURL[s.filter], Text: IfThenElse(state == 0, fmt.Sprintf("%d viewers", s.viewers), strings.TrimSuffix(s.length.Truncate(time.Minute).String(), "0s"))},
+		Fields:      newMsgFieldsFromStream(s, state),
 		Timestamp:   s.start.Format("2006-01-02T15:04:05Z"),
 	}
 }
 
-func calcFilter(r *helix.Stream) int {
-	if filterStream(r, blockTags, blockKeywords) {
+// called in msgAgent.load() to find the state of a msg (-1 if it isn't a stream msg): persisted in the author URL, so msgs are
+// recognised whatever colours they were posted in; msgs posted before it was persisted are matched by the default colours
+func msgStateOf(msg *discordgo.Message) int {
+	if len(msg.Embeds) != 1 || msg.Embeds[0].Author == nil {
+		return -1
+	}
+	if authorURL, err := url.Parse(msg.Embeds[0].Author.URL); err == nil {
+		if state, err := strconv.Atoi(authorURL.Query().Get("state")); err == nil {
+			return state
+		}
+	}
+	for state, colour := range defaultStyle.colours {
+		if msg.Embeds[0].Color == colour {
+			return state
+		}
+	}
+	return -1
+}
+
+// called only in newMsgFromStream: extra info on expiring/expired msgs (nil if none)
+func newMsgFieldsFromStream(s *stream, state int) []*discordgo.MessageEmbedField {
+	var fields []*discordgo.MessageEmbedField
+	if state == 2 && s.samples != 0 {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Viewers", Value: fmt.Sprintf("peak %d · avg %d", s.peak, s.viewerSum/s.samples), Inline: true})
+	}
+	if state != 0 && len(s.titles) > 1 {
+		timeline := make([]string, len(s.titles))
+		for i, t := range s.titles {
+			timeline[i] = fmt.Sprintf("%d:%02d %s", int(t.offset.Hours()), int(t.offset.Minutes())%60, t.title)
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Titles", Value: strings.Join(timeline, " → ")})
+	}
+	if state == 2 && s.vod != "" {
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "VOD", Value: fmt.Sprintf("[watch](%s)", s.vod), Inline: true})
+	}
+	if state == 2 && len(s.clips) != 0 {
+		lines := make([]string, len(s.clips))
+		for i, c := range s.clips {
+			lines[i] = fmt.Sprintf("[%s](%s) (%d views)", c.Title, c.URL, c.ViewCount)
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Clips", Value: strings.Join(lines, "\n")})
+	}
+	return fields
+}
+
+// state persisted in the query of the msg author URL (harmless to the link), beyond what the embed shows
+// capped at stateMax encoded: the least needed values are left out to fit (older titles, then tags, then the game name),
+// and the current title is cut short if even it doesn't fit
+func encodeState(s *stream) url.Values {
+	state := url.Values{"id": {s.userID}, "user": {s.user}, "stream": {s.streamID}, "v": {strconv.Itoa(s.viewers)}}
+	if s.language != "" {
+		state.Set("lang", s.language)
+	}
+	if s.mature {
+		state.Set("mature", "1")
+	}
+	if s.kind != "" {
+		state.Set("type", s.kind)
+	}
+	if s.gameID != "" {
+		state.Set("game", s.gameID)
+	}
+	if s.switchedTo != "" {
+		state.Set("to", s.switchedTo)
+	}
+	if s.samples != 0 {
+		state.Set("peak", strconv.Itoa(s.peak))
+		state.Set("avg", strconv.Itoa(s.viewerSum/s.samples))
+		state.Set("n", strconv.Itoa(s.samples))
+	}
+	// optional values, most needed first, while they fit (Japanese text grows ~9x when encoded)
+	fits := func(key, value string) bool {
+		return len(state.Encode())+len("&=")+len(url.QueryEscape(key))+len(url.QueryEscape(value)) <= stateMax
+	}
+	titleValue := func(t titleChange) string { // one value per change: "<minutes>:<title>"
+		return fmt.Sprintf("%d:%s", int(t.offset.Minutes()), t.title)
+	}
+	if n := len(s.titles); n != 0 {
+		latest := []rune(titleValue(s.titles[n-1]))
+		for !fits("t", string(latest)) {
+			latest = latest[:len(latest)-1]
+		}
+		state.Set("t", string(latest))
+	}
+	if s.game != "" && fits("gamename", s.game) {
+		state.Set("gamename", s.game)
+	}
+	for n := len(s.tags); n > 0; n-- { // as many tags as fit
+		if tags := strings.Join(s.tags[:n], ","); fits("tags", tags) {
+			state.Set("tags", tags)
+			break
+		}
+	}
+	for i := len(s.titles) - 2; i >= 0 && fits("t", titleValue(s.titles[i])); i-- { // older titles, newest first
+		state["t"] = append([]string{titleValue(s.titles[i])}, state["t"]...)
+	}
+	return state
+}
+
+// inverse of encodeState (missing values stay unset)
+func decodeState(s *stream, state url.Values) {
+	s.userID, s.user, s.streamID = state.Get("id"), state.Get("user"), state.Get("stream")
+	s.viewers, _ = strconv.Atoi(state.Get("v"))
+	s.language, s.mature, s.kind = state.Get("lang"), state.Get("mature") == "1", state.Get("type")
+	if tags := state.Get("tags"); tags != "" {
+		s.tags = strings.Split(tags, ",")
+	}
+	s.gameID, s.game, s.switchedTo = state.Get("game"), state.Get("gamename"), state.Get("to")
+	if n, err := strconv.Atoi(state.Get("n")); err == nil {
+		avg, _ := strconv.Atoi(state.Get("avg"))
+		s.peak, _ = strconv.Atoi(state.Get("peak"))
+		s.viewerSum, s.samples = avg*n, n
+	}
+	for _, t := range state["t"] {
+		if i := strings.IndexByte(t, ':'); i != -1 {
+			minutes, _ := strconv.Atoi(t[:i])
+			s.titles = append(s.titles, titleChange{time.Duration(minutes) * time.Minute, t[i+1:]})
+		}
+	}
+}
+
+// called in newStreamFromTwitch (and carryPeaks) – the filter is run on incoming data and used only when a new msg is made
+// the FILTER expression, if set, replaces the filter lists (and decides on dir users too); BLOCK applies on top of the block lists
+func calcFilter(s *stream) int {
+	known := dir.Get(strings.ToLower(s.login)) != ""
+	if blockExpr != nil && blockExpr.Eval(s.subject()) || filterStream(s, blockTags, blockKeywords) {
+		return -1
+	} else if containsFold(blockLanguages, s.language) || !known && s.peak < minViewers { // (peak, so dips don't end streams)
 		return -1
-	} else if dir.Get(strings.ToLower(r.UserName)) != "" {
+	} else if filterExpr != nil && !filterExpr.Eval(s.subject()) {
+		return 0
+	} else if known {
 		return 2
-	} else if filterStream(r, filterTags, filterKeywords) {
+	} else if filterExpr != nil {
 		return 1
-	} else {
+	} else if filterTags == nil && filterKeywords == nil && filterLanguages == nil {
+		return 0 // no lists to pass
+	} else if (filterTags != nil || filterKeywords != nil) && !filterStream(s, filterTags, filterKeywords) {
+		return 0
+	} else if filterLanguages != nil && !containsFold(filterLanguages, s.language) {
 		return 0
+	} else {
+		return 1
 	}
 }
 
-// called only in newStreamFromTwitch – the filter is run on incoming data and used only when a new msg is made
-func filterStream(r *helix.Stream, tags []string, keywords []string) bool {
+// the properties of the stream that filter expressions test
+func (s *stream) subject() *filter.Stream {
+	return &filter.Stream{
+		Login:    s.login,
+		User:     s.user,
+		Title:    s.title,
+		Language: s.language,
+		GameID:   s.gameID,
+		GameName: s.game,
+		Type:     s.kind,
+		Tags:     append(append([]string{}, s.tags...), s.tagIDs...),
+		Viewers:  s.peak, // (so a stream that passed doesn't drop out when its count dips)
+		Known:    dir.Get(strings.ToLower(s.login)) != "",
+		Mature:   s.mature,
+	}
+}
+
+// tags match freeform tags case-insensitively, or legacy tag UUIDs (still in older configs)
+func filterStream(s *stream, tags []string, keywords []*regexp.Regexp) bool {
 	// check tags
-	for _, tag1 := range r.TagIDs {
-		for _, tag2 := range tags {
-			if tag1 == tag2 {
-				return true
-			}
+	for _, tag := range tags {
+		if containsFold(s.tags, tag) || containsFold(s.tagIDs, tag) {
+			return true
 		}
 	}
 	// check keywords
-	title := strings.ToLower(r.Title)
 	for _, keyword := range keywords {
-		if strings.Contains(title, keyword) {
+		if keyword.MatchString(s.title) {
 			return true
 		}
 	}
@@ -119,11 +392,21 @@ func filterStream(r *helix.Stream, tags []string, keywords []string) bool {
 	return false
 }
 
-// called only in main() to subset streams using stream.filter >= 1 before passing to filtered msg agents
-func subsetStreams(input map[string]*stream) map[string]*stream {
+// as contains, but ignoring case
+func containsFold(list []string, item string) bool {
+	for _, t := range list {
+		if strings.EqualFold(t, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// called only in main() to subset streams per msg agent, using the agent's filter
+func subsetStreams(input map[string]*stream, accepts func(*stream) bool) map[string]*stream {
 	output := make(map[string]*stream)
 	for user, stream := range input {
-		if stream.filter >= 1 {
+		if accepts(stream) {
 			output[user] = stream
 		}
 	}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCalcFilterLists(t *testing.T) {
+	t.Cleanup(func() { filterTags, filterKeywords, filterLanguages = nil, nil, nil })
+	en, ja := testStream("3", "Carol"), testStream("4", "Dave") // (not in dir, which another test may have loaded)
+	en.language, ja.language = "en", "ja"
+	en.tags = []string{"Speedrun"}
+	tests := []struct {
+		tags, languages []string
+		keywords        []*regexp.Regexp
+		en, ja          int // filter values wanted
+	}{
+		{nil, nil, nil, 0, 0},
+		{[]string{"speedrun"}, nil, nil, 1, 0},
+		{nil, []string{"en"}, nil, 1, 0}, // (languages alone are a filter too)
+		{[]string{"speedrun"}, []string{"ja"}, nil, 0, 0},
+		{nil, []string{"JA"}, []*regexp.Regexp{regexp.MustCompile(`(?i)stream`)}, 0, 1},
+	}
+	for _, test := range tests {
+		filterTags, filterLanguages, filterKeywords = test.tags, test.languages, test.keywords
+		if got := calcFilter(en); got != test.en {
+			t.Errorf("tags %v, languages %v, keywords %v: en stream filter %d, want %d", test.tags, test.languages, test.keywords, got, test.en)
+		}
+		if got := calcFilter(ja); got != test.ja {
+			t.Errorf("tags %v, languages %v, keywords %v: ja stream filter %d, want %d", test.tags, test.languages, test.keywords, got, test.ja)
+		}
+	}
+}
+
+// a stream is blocked until its viewers reach MIN_VIEWERS, then stays however they dip (for the rest of the broadcast)
+func TestMinViewersHysteresis(t *testing.T) {
+	t.Cleanup(func() { minViewers = 0 })
+	minViewers = 10
+	var last map[string]*stream
+	for i, step := range []struct {
+		streamID string
+		viewers  int
+		blocked  bool
+	}{{"91", 2, true}, {"91", 12, false}, {"91", 8, false}, {"91", 0, false}, {"92", 8, true}} {
+		s := testStream("3", "Carol")
+		s.streamID, s.viewers, s.peak = step.streamID, step.viewers, step.viewers
+		s.filter = calcFilter(s)
+		new := map[string]*stream{"3": s}
+		if last != nil {
+			carryPeaks(new, last)
+		}
+		if blocked := s.filter == -1; blocked != step.blocked {
+			t.Errorf("poll %d (%d viewers): blocked %t, want %t", i, step.viewers, blocked, step.blocked)
+		}
+		last = new
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+type utilsClock interface {
+	Now() time.Time                         // current time
+	Since(t time.Time) time.Duration        // time elapsed since t
+	Sleep(d time.Duration)                  // blocks for d
+	After(d time.Duration) <-chan time.Time // fires once d has passed
+}
+
+// Clock : the time source for timing logic (expiries, polls, rate-limit sleeps); real unless set to a SimClock at init
+var Clock utilsClock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SimClock : simulated time, which only moves when advanced (by one thread, e.g. to the time of each replayed snapshot):
+// sleeps and timers return straight away without moving it, so hours of activity run in seconds, and sleeps in
+// concurrent threads don't add up; safe for concurrent use
+type SimClock struct {
+	now       time.Time  // simulated current time
+	start     time.Time  // simulated time at creation
+	realStart time.Time  // real time at creation
+	lock      sync.Mutex // mutex for now
+}
+
+// NewSimClock : constructor for a SimClock starting at a given time
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start, start: start, realStart: time.Now()}
+}
+
+// Now : current simulated time
+func (c *SimClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Since : simulated time elapsed since t
+func (c *SimClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// Sleep : returns immediately (the simulation doesn't wait)
+func (c *SimClock) Sleep(d time.Duration) {}
+
+// After : fires immediately (whatever advances the clock decides when things happen)
+func (c *SimClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+// AdvanceTo : moves simulated time forward to t (no-op if t isn't in the future)
+func (c *SimClock) AdvanceTo(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// Elapsed : simulated and real time elapsed since creation
+func (c *SimClock) Elapsed() (simulated, real time.Duration) {
+	return c.Since(c.start), time.Since(c.realStart)
+}